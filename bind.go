@@ -0,0 +1,388 @@
+package vermouth
+
+import (
+	"encoding"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxBindBodySize is the maximum number of bytes Bind reads from a request body.
+var MaxBindBodySize int64 = 10 << 20
+
+// MaxBindMemory is the maximum number of bytes of a multipart form Bind keeps in memory.
+var MaxBindMemory int64 = 32 << 20
+
+// ErrUnsupportedMediaType is returned by Bind for a request body it cannot decode.
+var ErrUnsupportedMediaType = errors.New("vermouth: unsupported media type")
+
+// Sources of a bound value, as reported by FieldError.
+const (
+	SourcePath   = "path"
+	SourceQuery  = "query"
+	SourceHeader = "header"
+	SourceForm   = "form"
+	SourceBody   = "body"
+)
+
+// FieldError describes a value which could not be bound or validated.
+type FieldError struct {
+	// Source is where the value came from, e.g. "query" or "body".
+	Source string `json:"source"`
+	// Name is the parameter name, or a JSON pointer for body fields.
+	Name string `json:"name"`
+	// Field is the Go path of the struct field.
+	Field string `json:"field"`
+	// Value is the offending input, if any.
+	Value string `json:"value,omitempty"`
+	Err   error  `json:"-"`
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Source, e.Name, e.Err)
+}
+
+// MarshalJSON includes the error message.
+func (e *FieldError) MarshalJSON() ([]byte, error) {
+	type fieldError FieldError
+	return json.Marshal(struct {
+		*fieldError
+		Message string `json:"message"`
+	}{(*fieldError)(e), e.Err.Error()})
+}
+
+// BindError is returned by Bind and lists every value which failed.
+type BindError struct {
+	// Status is the HTTP status code describing the failure.
+	Status int
+	// Err is set when the request body as a whole could not be read.
+	Err    error
+	Fields []*FieldError
+}
+
+func (e *BindError) Error() string {
+	if e.Err != nil {
+		return "vermouth: binding request: " + e.Err.Error()
+	}
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.Error()
+	}
+	return "vermouth: binding request: " + strings.Join(msgs, "; ")
+}
+
+// StatusCode returns the HTTP status code to respond with.
+func (e *BindError) StatusCode() int {
+	return e.Status
+}
+
+// FieldErrors returns the fields which could not be bound.
+func (e *BindError) FieldErrors() []*FieldError {
+	return e.Fields
+}
+
+// Bind populates the struct pointed to by dst from the request.
+//
+// Fields are filled from the sources named by their tags:
+//
+//	path:"id"          path parameter of the router
+//	query:"page"       URL query parameter
+//	header:"X-Tenant"  request header
+//	form:"name"        urlencoded or multipart form field
+//	json:"name"        JSON body (encoding/json rules)
+//	xml:"name"         XML body (encoding/xml rules)
+//
+// The body decoder is picked by the Content-Type header, and at most
+// MaxBindBodySize bytes are read. Strings are converted to the field type,
+// which may be a pointer, a slice, any basic kind, time.Duration, time.Time
+// (RFC 3339) or an encoding.TextUnmarshaler. Untagged struct fields are
+// bound into as well; a nil pointer to a struct is only allocated when one
+// of its fields is found in the request.
+//
+// On failure a *BindError listing every failing field is returned.
+// Once every value is bound, dst is checked with Validate, and a
+// *ValidationError is returned if a rule is violated.
+func Bind(r *http.Request, dst interface{}) error {
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		panic("vermouth: Bind destination must be a pointer to a struct")
+	}
+	if err := bindBody(r, dst); err != nil {
+		return err
+	}
+
+	b := &binder{r: r}
+	b.params, _ = r.Context().Value(ParamsCtxKey).(Params)
+	b.bindStruct(rv.Elem(), "")
+	if len(b.errs) > 0 {
+		return &BindError{Status: http.StatusBadRequest, Fields: b.errs}
+	}
+	return Validate(dst)
+}
+
+func bindBody(r *http.Request, dst interface{}) error {
+	if r.Body == nil || r.Body == http.NoBody || r.Method == "GET" || r.Method == "HEAD" {
+		return nil
+	}
+	ct := r.Header.Get("Content-Type")
+	if ct == "" {
+		return nil
+	}
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return &BindError{Status: http.StatusUnsupportedMediaType, Err: ErrUnsupportedMediaType}
+	}
+	r.Body = http.MaxBytesReader(nil, r.Body, MaxBindBodySize)
+
+	switch {
+	case mt == "application/json" || strings.HasSuffix(mt, "+json"):
+		err = json.NewDecoder(r.Body).Decode(dst)
+		if err == io.EOF {
+			err = nil
+		}
+	case mt == "application/xml" || mt == "text/xml" || strings.HasSuffix(mt, "+xml"):
+		err = xml.NewDecoder(r.Body).Decode(dst)
+		if err == io.EOF {
+			err = nil
+		}
+	case mt == "application/x-www-form-urlencoded":
+		err = r.ParseForm()
+	case mt == "multipart/form-data":
+		err = r.ParseMultipartForm(MaxBindMemory)
+	default:
+		return &BindError{Status: http.StatusUnsupportedMediaType, Err: ErrUnsupportedMediaType}
+	}
+	if err == nil {
+		return nil
+	}
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return &BindError{Status: http.StatusRequestEntityTooLarge, Err: err}
+	}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return &BindError{Status: http.StatusBadRequest, Fields: []*FieldError{{
+			Source: SourceBody,
+			Name:   jsonPointer(typeErr.Field),
+			Field:  typeErr.Field,
+			Value:  typeErr.Value,
+			Err:    fmt.Errorf("cannot be decoded into %s", typeErr.Type),
+		}}}
+	}
+	return &BindError{Status: http.StatusBadRequest, Err: err}
+}
+
+type binder struct {
+	r        *http.Request
+	params   Params
+	errs     []*FieldError
+	visiting map[reflect.Type]bool
+}
+
+var (
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	durationType        = reflect.TypeOf(time.Duration(0))
+	timeType            = reflect.TypeOf(time.Time{})
+)
+
+// bindStruct binds the tagged fields of v and reports whether any value was
+// found. Nested structs without a tag are descended into, but a nil pointer
+// to one is only allocated when a value is bound into it, and a struct type
+// is not descended into again while it is being bound, so that recursive
+// types terminate.
+func (b *binder) bindStruct(v reflect.Value, prefix string) bool {
+	t := v.Type()
+	if b.visiting == nil {
+		b.visiting = make(map[reflect.Type]bool)
+	}
+	b.visiting[t] = true
+	defer delete(b.visiting, t)
+
+	bound := false
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		fv := v.Field(i)
+		field := prefix + sf.Name
+
+		source, name, values, found := b.lookup(sf)
+		if source == "" {
+			// descend into nested structs without a binding tag
+			ft := sf.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() != reflect.Struct || ft == timeType || reflect.PtrTo(ft).Implements(textUnmarshalerType) || sf.Tag.Get("json") != "" || b.visiting[ft] {
+				continue
+			}
+			if fv.Kind() != reflect.Ptr {
+				if b.bindStruct(fv, field+".") {
+					bound = true
+				}
+				continue
+			}
+			nv := fv
+			if fv.IsNil() {
+				nv = reflect.New(ft)
+			}
+			if b.bindStruct(nv.Elem(), field+".") {
+				fv.Set(nv)
+				bound = true
+			}
+			continue
+		}
+		if !found {
+			continue
+		}
+		bound = true
+		if err := setValues(fv, values); err != nil {
+			b.errs = append(b.errs, &FieldError{
+				Source: source,
+				Name:   name,
+				Field:  field,
+				Value:  strings.Join(values, ","),
+				Err:    err,
+			})
+		}
+	}
+	return bound
+}
+
+// lookup returns the first source tagged on sf and the raw values found there.
+func (b *binder) lookup(sf reflect.StructField) (source, name string, values []string, found bool) {
+	if name = tagName(sf, SourcePath); name != "" {
+		for _, p := range b.params {
+			if p.Key == name {
+				return SourcePath, name, []string{p.Value}, true
+			}
+		}
+		return SourcePath, name, nil, false
+	}
+	if name = tagName(sf, SourceQuery); name != "" {
+		values, found = b.r.URL.Query()[name]
+		return SourceQuery, name, values, found
+	}
+	if name = tagName(sf, SourceHeader); name != "" {
+		values, found = b.r.Header[http.CanonicalHeaderKey(name)]
+		return SourceHeader, name, values, found
+	}
+	if name = tagName(sf, SourceForm); name != "" {
+		if b.r.PostForm != nil {
+			values, found = b.r.PostForm[name]
+		}
+		if !found && b.r.MultipartForm != nil {
+			values, found = b.r.MultipartForm.Value[name]
+		}
+		return SourceForm, name, values, found
+	}
+	return "", "", nil, false
+}
+
+func tagName(sf reflect.StructField, key string) string {
+	tag := sf.Tag.Get(key)
+	if i := strings.IndexByte(tag, ','); i >= 0 {
+		tag = tag[:i]
+	}
+	if tag == "-" {
+		return ""
+	}
+	return tag
+}
+
+func setValues(v reflect.Value, values []string) error {
+	if v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8 && !v.Addr().Type().Implements(textUnmarshalerType) {
+		slice := reflect.MakeSlice(v.Type(), len(values), len(values))
+		for i, s := range values {
+			if err := setValue(slice.Index(i), s); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+		return nil
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	return setValue(v, values[0])
+}
+
+func setValue(v reflect.Value, s string) error {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return setValue(v.Elem(), s)
+	}
+	if v.CanAddr() && v.Addr().Type().Implements(textUnmarshalerType) {
+		return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+	}
+	switch v.Type() {
+	case durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return errors.New("must be a duration")
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return errors.New("must be a boolean")
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return errors.New("must be an integer")
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return errors.New("must be a non-negative integer")
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return errors.New("must be a number")
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.Uint8 {
+			return fmt.Errorf("unsupported type %s", v.Type())
+		}
+		v.SetBytes([]byte(s))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// jsonPointer converts the dotted field path of encoding/json into a JSON pointer.
+func jsonPointer(path string) string {
+	if path == "" {
+		return ""
+	}
+	parts := strings.Split(path, ".")
+	for i, p := range parts {
+		parts[i] = escapePointer(p)
+	}
+	return "/" + strings.Join(parts, "/")
+}
@@ -0,0 +1,125 @@
+package vermouth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type bindTarget struct {
+	ID      int           `path:"id"`
+	Page    *int          `query:"page"`
+	Tags    []string      `query:"tag"`
+	Timeout time.Duration `query:"timeout"`
+	Tenant  string        `header:"X-Tenant"`
+	Name    string        `json:"name" form:"name"`
+	Age     int           `json:"age"`
+	Filter  struct {
+		Since time.Time `query:"since"`
+	}
+}
+
+func TestBindJSON(t *testing.T) {
+	var dst bindTarget
+	vm := New()
+	vm.Post("/users/:id", func(w http.ResponseWriter, r *http.Request) {
+		if err := Bind(r, &dst); err != nil {
+			t.Fatal(err)
+		}
+	})
+	req := httptest.NewRequest("POST", "/users/42?page=3&tag=a&tag=b&timeout=5s&since=2020-01-02T03:04:05Z", strings.NewReader(`{"name":"alice","age":30}`))
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("X-Tenant", "acme")
+	vm.ServeHTTP(httptest.NewRecorder(), req)
+
+	expect(t, dst.ID, 42)
+	expect(t, *dst.Page, 3)
+	expect(t, strings.Join(dst.Tags, ","), "a,b")
+	expect(t, dst.Timeout, 5*time.Second)
+	expect(t, dst.Tenant, "acme")
+	expect(t, dst.Name, "alice")
+	expect(t, dst.Age, 30)
+	expect(t, dst.Filter.Since.Year(), 2020)
+}
+
+func TestBindForm(t *testing.T) {
+	var dst bindTarget
+	req := httptest.NewRequest("POST", "/", strings.NewReader(url.Values{"name": {"bob"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if err := Bind(req, &dst); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, dst.Name, "bob")
+}
+
+func TestBindErrors(t *testing.T) {
+	var dst bindTarget
+	req := httptest.NewRequest("GET", "/?page=x&timeout=soon", nil)
+	err := Bind(req, &dst)
+	be, ok := err.(*BindError)
+	if !ok {
+		t.Fatalf("expected *BindError, got %v", err)
+	}
+	expect(t, be.StatusCode(), http.StatusBadRequest)
+	expect(t, len(be.Fields), 2)
+	expect(t, be.Fields[0].Source, SourceQuery)
+	expect(t, be.Fields[0].Name, "page")
+	expect(t, be.Fields[1].Name, "timeout")
+
+	req = httptest.NewRequest("POST", "/", strings.NewReader(`{"age":"old"}`))
+	req.Header.Set("Content-Type", "application/json")
+	be = Bind(req, &dst).(*BindError)
+	expect(t, be.Fields[0].Source, SourceBody)
+	expect(t, be.Fields[0].Name, "/age")
+
+	req = httptest.NewRequest("POST", "/", strings.NewReader(`name=x`))
+	req.Header.Set("Content-Type", "text/csv")
+	expect(t, Bind(req, &dst).(*BindError).StatusCode(), http.StatusUnsupportedMediaType)
+
+	defer func(n int64) { MaxBindBodySize = n }(MaxBindBodySize)
+	MaxBindBodySize = 8
+	req = httptest.NewRequest("POST", "/", strings.NewReader(`{"name":"a very long name"}`))
+	req.Header.Set("Content-Type", "application/json")
+	expect(t, Bind(req, &dst).(*BindError).StatusCode(), http.StatusRequestEntityTooLarge)
+}
+
+type bindNode struct {
+	Name string `query:"name"`
+	Next *bindNode
+}
+
+func TestBindRecursiveType(t *testing.T) {
+	var dst bindNode
+	req := httptest.NewRequest("GET", "/?name=head", nil)
+	done := make(chan error, 1)
+	go func() { done <- Bind(req, &dst) }()
+	select {
+	case err := <-done:
+		expect(t, err, nil)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Bind did not return")
+	}
+	expect(t, dst.Name, "head")
+	expect(t, dst.Next == nil, true)
+}
+
+func TestBindOptionalNestedPointer(t *testing.T) {
+	type address struct {
+		City string `query:"city"`
+	}
+	var dst struct {
+		Address *address `validate:"required"`
+	}
+	err := Bind(httptest.NewRequest("GET", "/", nil), &dst)
+	expect(t, dst.Address == nil, true)
+	if _, ok := err.(*ValidationError); !ok {
+		t.Fatalf("expected *ValidationError, got %v", err)
+	}
+
+	err = Bind(httptest.NewRequest("GET", "/?city=Paris", nil), &dst)
+	expect(t, err, nil)
+	expect(t, dst.Address.City, "Paris")
+}
@@ -0,0 +1,247 @@
+package vermouth
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// ErrCommitted is returned when a BufferedResponseWriter is used after Commit.
+var ErrCommitted = errors.New("vermouth: response already committed")
+
+// DefaultSpillThreshold is the SpillThreshold of new BufferedResponseWriters.
+var DefaultSpillThreshold = 1 << 20
+
+// BufferedResponseWriter is a ResponseWriter which holds the status, header
+// and body of a response until Commit sends them to the wrapped writer. Until
+// then the response can be inspected, rewritten or discarded with Reset,
+// e.g. by middleware rendering error pages or computing ETags.
+//
+// Bodies larger than SpillThreshold are moved from memory to a temporary
+// file, which is removed by Commit or Reset, or when the middleware stack of
+// a wrapped vermouth ResponseWriter returns. Before functions run once, when
+// the response is committed. The writer does not implement http.Flusher or
+// http.Hijacker, and Unwrap returns nil, so that http.ResponseController
+// cannot bypass the buffer. As Commit declares the Content-Length of the
+// buffered body, writes after Commit fail with ErrCommitted.
+type BufferedResponseWriter struct {
+	// SpillThreshold is the body size kept in memory. If it is not
+	// positive, the body is never spilled.
+	SpillThreshold int
+
+	// TempDir is the directory of spill files, os.TempDir if empty.
+	TempDir string
+
+	w           http.ResponseWriter
+	header      http.Header
+	status      int
+	size        int
+	wroteHeader bool
+	wroteBody   bool
+	committed   bool
+	buf         bytes.Buffer
+	file        *os.File
+	beforeFuncs []beforeFunc
+}
+
+// NewBufferedResponseWriter returns a BufferedResponseWriter wrapping w. Its
+// header starts as a copy of the header of w.
+func NewBufferedResponseWriter(w http.ResponseWriter) *BufferedResponseWriter {
+	b := &BufferedResponseWriter{
+		SpillThreshold: DefaultSpillThreshold,
+		w:              w,
+		header:         w.Header().Clone(),
+	}
+	if rw, ok := w.(ResponseWriter); ok {
+		// removes the spill file of a response which was never committed
+		rw.After(func(ResponseWriter) { b.discard() })
+	}
+	return b
+}
+
+func (b *BufferedResponseWriter) Header() http.Header {
+	if b.committed {
+		return b.w.Header()
+	}
+	return b.header
+}
+
+// WriteHeader records the status code. Informational 1xx codes and calls
+// after the first are ignored.
+func (b *BufferedResponseWriter) WriteHeader(s int) {
+	if b.committed {
+		return
+	}
+	if b.wroteHeader || (s >= 100 && s < 200 && s != http.StatusSwitchingProtocols) {
+		return
+	}
+	b.wroteHeader = true
+	b.status = s
+}
+
+func (b *BufferedResponseWriter) Write(p []byte) (int, error) {
+	if b.committed {
+		return 0, ErrCommitted
+	}
+	if !b.wroteHeader {
+		b.WriteHeader(http.StatusOK)
+	}
+	b.wroteBody = true
+	if b.file == nil && b.SpillThreshold > 0 && b.buf.Len()+len(p) > b.SpillThreshold {
+		if err := b.spill(); err != nil {
+			return 0, err
+		}
+	}
+	var n int
+	var err error
+	if b.file != nil {
+		n, err = b.file.Write(p)
+	} else {
+		n, err = b.buf.Write(p)
+	}
+	b.size += n
+	return n, err
+}
+
+// spill moves the buffered body to a temporary file.
+func (b *BufferedResponseWriter) spill() error {
+	f, err := ioutil.TempFile(b.TempDir, "vermouth-body-")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b.buf.Bytes()); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	b.buf.Reset()
+	b.file = f
+	return nil
+}
+
+func (b *BufferedResponseWriter) Status() int {
+	return b.status
+}
+
+func (b *BufferedResponseWriter) Written() bool {
+	return b.wroteHeader
+}
+
+func (b *BufferedResponseWriter) BodyWritten() bool {
+	return b.wroteBody
+}
+
+func (b *BufferedResponseWriter) Size() int {
+	return b.size
+}
+
+// Spilled returns whether the body has been moved to a temporary file.
+func (b *BufferedResponseWriter) Spilled() bool {
+	return b.file != nil
+}
+
+// Committed returns whether Commit has been called.
+func (b *BufferedResponseWriter) Committed() bool {
+	return b.committed
+}
+
+func (b *BufferedResponseWriter) Before(before func(ResponseWriter)) {
+	b.beforeFuncs = append(b.beforeFuncs, before)
+}
+
+// After registers the function on the wrapped writer, if it is a ResponseWriter.
+func (b *BufferedResponseWriter) After(after func(ResponseWriter)) {
+	if rw, ok := b.w.(ResponseWriter); ok {
+		rw.After(func(ResponseWriter) { after(b) })
+	}
+}
+
+// OnFlush has no effect, as a buffered response cannot be flushed.
+func (b *BufferedResponseWriter) OnFlush(func(ResponseWriter)) {}
+
+// OnHijack has no effect, as a buffered response cannot be hijacked.
+func (b *BufferedResponseWriter) OnHijack(func(ResponseWriter)) {}
+
+// Unwrap returns nil, so that http.ResponseController cannot reach the
+// wrapped writer past the buffer.
+func (b *BufferedResponseWriter) Unwrap() http.ResponseWriter {
+	return nil
+}
+
+// Body returns the buffered body. A spilled body is read back from its file.
+func (b *BufferedResponseWriter) Body() ([]byte, error) {
+	if b.committed {
+		return nil, ErrCommitted
+	}
+	if b.file == nil {
+		return b.buf.Bytes(), nil
+	}
+	return ioutil.ReadAll(io.NewSectionReader(b.file, 0, int64(b.size)))
+}
+
+// Reset discards the status, body and header changes, as if nothing had been
+// written. It has no effect after Commit.
+func (b *BufferedResponseWriter) Reset() {
+	if b.committed {
+		return
+	}
+	b.discard()
+	b.header = b.w.Header().Clone()
+	b.status, b.size = 0, 0
+	b.wroteHeader, b.wroteBody = false, false
+}
+
+func (b *BufferedResponseWriter) discard() {
+	b.buf.Reset()
+	if b.file != nil {
+		b.file.Close()
+		os.Remove(b.file.Name())
+		b.file = nil
+	}
+}
+
+// Commit runs the Before functions and writes the buffered response to the
+// wrapped writer. Without a status code, 200 is sent. Content-Length is set
+// unless the header already has one. Calling Commit more than once has no
+// effect.
+func (b *BufferedResponseWriter) Commit() error {
+	if b.committed {
+		return nil
+	}
+	if !b.wroteHeader {
+		b.WriteHeader(http.StatusOK)
+	}
+	for i := len(b.beforeFuncs) - 1; i >= 0; i-- {
+		b.beforeFuncs[i](b)
+	}
+	b.committed = true
+	defer b.discard()
+
+	dst := b.w.Header()
+	for k := range dst {
+		if _, ok := b.header[k]; !ok {
+			delete(dst, k)
+		}
+	}
+	for k, v := range b.header {
+		dst[k] = v
+	}
+	if dst.Get("Content-Length") == "" && dst.Get("Transfer-Encoding") == "" && bodyAllowed(b.status) {
+		dst.Set("Content-Length", strconv.Itoa(b.size))
+	}
+	b.w.WriteHeader(b.status)
+	if b.file != nil {
+		_, err := io.Copy(b.w, io.NewSectionReader(b.file, 0, int64(b.size)))
+		return err
+	}
+	_, err := b.w.Write(b.buf.Bytes())
+	return err
+}
+
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
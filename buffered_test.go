@@ -0,0 +1,182 @@
+package vermouth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestBufferedResponseWriterCommit(t *testing.T) {
+	rec := httptest.NewRecorder()
+	rw := NewResponseWriter(rec)
+	outer := 0
+	rw.Before(func(ResponseWriter) {
+		outer++
+	})
+	b := NewBufferedResponseWriter(rw)
+	calls := 0
+	b.Before(func(w ResponseWriter) {
+		calls++
+		w.Header().Set("ETag", `"abc"`)
+	})
+
+	b.Header().Set("Content-Type", "text/plain")
+	b.WriteHeader(http.StatusCreated)
+	b.Write([]byte("hello"))
+
+	expect(t, rec.Code, http.StatusOK)
+	expect(t, rec.Body.Len(), 0)
+	expect(t, rw.Written(), false)
+	expect(t, calls, 0)
+	body, err := b.Body()
+	expect(t, err, nil)
+	expect(t, string(body), "hello")
+	expect(t, b.Status(), http.StatusCreated)
+	expect(t, b.Size(), 5)
+
+	expect(t, b.Commit(), nil)
+	expect(t, b.Commit(), nil)
+	expect(t, calls, 1)
+	expect(t, outer, 1)
+	expect(t, rec.Code, http.StatusCreated)
+	expect(t, rec.Body.String(), "hello")
+	expect(t, rec.Header().Get("ETag"), `"abc"`)
+	expect(t, rec.Header().Get("Content-Type"), "text/plain")
+	expect(t, rec.Header().Get("Content-Length"), "5")
+
+	// later writes would exceed the Content-Length
+	_, err = b.Write([]byte(" world"))
+	expect(t, err, ErrCommitted)
+	expect(t, rec.Body.String(), "hello")
+	_, err = b.Body()
+	expect(t, err, ErrCommitted)
+}
+
+func TestBufferedResponseWriterReset(t *testing.T) {
+	rec := httptest.NewRecorder()
+	rec.Header().Set("X-Request-Id", "1")
+	b := NewBufferedResponseWriter(rec)
+
+	b.Header().Set("Content-Type", "application/json")
+	b.Header().Del("X-Request-Id")
+	b.WriteHeader(http.StatusInternalServerError)
+	b.Write([]byte(`{"error":"boom"}`))
+
+	b.Reset()
+	expect(t, b.Status(), 0)
+	expect(t, b.Written(), false)
+	expect(t, b.BodyWritten(), false)
+	expect(t, b.Size(), 0)
+	expect(t, b.Header().Get("Content-Type"), "")
+	expect(t, b.Header().Get("X-Request-Id"), "1")
+
+	b.WriteHeader(http.StatusServiceUnavailable)
+	b.Write([]byte("error page"))
+	b.Commit()
+	expect(t, rec.Code, http.StatusServiceUnavailable)
+	expect(t, rec.Body.String(), "error page")
+	expect(t, rec.Header().Get("Content-Type"), "")
+	expect(t, rec.Header().Get("X-Request-Id"), "1")
+}
+
+func TestBufferedResponseWriterHeaderRemoval(t *testing.T) {
+	rec := httptest.NewRecorder()
+	rec.Header().Set("X-Powered-By", "vermouth")
+	b := NewBufferedResponseWriter(rec)
+	b.Header().Del("X-Powered-By")
+	b.Commit()
+
+	expect(t, rec.Header().Get("X-Powered-By"), "")
+	expect(t, rec.Code, http.StatusOK)
+	expect(t, rec.Header().Get("Content-Length"), "0")
+}
+
+func TestBufferedResponseWriterSpill(t *testing.T) {
+	rec := httptest.NewRecorder()
+	b := NewBufferedResponseWriter(rec)
+	b.SpillThreshold = 8
+	b.TempDir = t.TempDir()
+
+	b.Write([]byte("12345"))
+	expect(t, b.Spilled(), false)
+	b.Write([]byte("67890"))
+	expect(t, b.Spilled(), true)
+	b.Write([]byte("abc"))
+
+	body, err := b.Body()
+	expect(t, err, nil)
+	expect(t, string(body), "1234567890abc")
+
+	name := b.file.Name()
+	expect(t, b.Commit(), nil)
+	expect(t, rec.Body.String(), "1234567890abc")
+	expect(t, rec.Header().Get("Content-Length"), "13")
+	expect(t, b.Spilled(), false)
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Error("spill file was not removed")
+	}
+}
+
+func TestBufferedResponseWriterInterfaces(t *testing.T) {
+	var w ResponseWriter = NewBufferedResponseWriter(httptest.NewRecorder())
+	_, ok := w.(http.Flusher)
+	expect(t, ok, false)
+	_, ok = w.(http.Hijacker)
+	expect(t, ok, false)
+	err := http.NewResponseController(w).Flush()
+	expect(t, errors.Is(err, http.ErrNotSupported), true)
+}
+
+func TestBufferedResponseWriterMiddleware(t *testing.T) {
+	vm := New()
+	vm.Use("", HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		b := NewBufferedResponseWriter(w)
+		next(b, r)
+		if b.Status() >= 500 {
+			b.Reset()
+			b.WriteHeader(http.StatusInternalServerError)
+			b.Write([]byte("something went wrong"))
+		}
+		b.Commit()
+	}))
+	vm.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "secret stack trace", http.StatusInternalServerError)
+	})
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	vm.ServeHTTP(rec, req)
+	expect(t, rec.Code, http.StatusInternalServerError)
+	expect(t, strings.Contains(rec.Body.String(), "secret"), false)
+	expect(t, rec.Body.String(), "something went wrong")
+}
+
+func TestBufferedResponseWriterRemovesSpillFileAfterPanic(t *testing.T) {
+	var name string
+	vm := New()
+	vm.Use("", HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		b := NewBufferedResponseWriter(w)
+		b.SpillThreshold = 4
+		b.TempDir = t.TempDir()
+		next(b, r)
+		name = b.file.Name()
+		panic("neither committed nor reset")
+	}))
+	vm.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("spilled body"))
+	})
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	func() {
+		defer func() { recover() }()
+		vm.ServeHTTP(rec, req)
+	}()
+	refute(t, name, "")
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Error("spill file was not removed")
+	}
+}
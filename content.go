@@ -0,0 +1,325 @@
+package vermouth
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errInvalidRange       = errors.New("vermouth: invalid range")
+	errUnsatisfiableRange = errors.New("vermouth: unsatisfiable range")
+)
+
+// ServeContent replies to the request with content, whose size is found by
+// seeking to its end. See ServeReaderAt.
+func ServeContent(w http.ResponseWriter, r *http.Request, name string, modtime time.Time, content io.ReadSeeker) {
+	size, err := content.Seek(0, io.SeekEnd)
+	if err != nil {
+		http.Error(w, "seeker can't seek", http.StatusInternalServerError)
+		return
+	}
+	ServeReaderAt(w, r, name, modtime, &seekerAt{rs: content}, size)
+}
+
+// ServeReaderAt replies to the request with the size bytes of content, so
+// that handlers can serve generated downloads which clients can resume.
+//
+// Range requests with one or more byte ranges are answered with 206 Partial
+// Content, multiple ranges as multipart/byteranges, and unsatisfiable ones
+// with 416. A Range is ignored when its unit is not bytes, when the content
+// is empty, or when an If-Range header does not match the ETag set on w or
+// modtime. If-Match, If-None-Match, If-Modified-Since and
+// If-Unmodified-Since are answered with 412 or 304.
+//
+// Without a Content-Type header, the type is derived from the extension of
+// name or, failing that, sniffed from the first 512 bytes. modtime is sent as
+// Last-Modified and compared with the conditional headers unless it is zero
+// or the Unix epoch.
+func ServeReaderAt(w http.ResponseWriter, r *http.Request, name string, modtime time.Time, content io.ReaderAt, size int64) {
+	h := w.Header()
+	if modtime.Equal(time.Unix(0, 0)) {
+		// the Unix epoch is as good as unknown, for the conditional
+		// headers as well
+		modtime = time.Time{}
+	}
+	if !modtime.IsZero() {
+		h.Set("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+	}
+	if status := checkPreconditions(r, h.Get("ETag"), modtime); status != 0 {
+		if status == http.StatusNotModified {
+			h.Del("Content-Type")
+			h.Del("Content-Length")
+			w.WriteHeader(status)
+		} else {
+			http.Error(w, http.StatusText(status), status)
+		}
+		return
+	}
+
+	ctype := h.Get("Content-Type")
+	if _, ok := h["Content-Type"]; !ok {
+		ctype = mime.TypeByExtension(filepath.Ext(name))
+		if ctype == "" {
+			buf := make([]byte, 512)
+			n, err := content.ReadAt(buf, 0)
+			if err != nil && err != io.EOF {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			ctype = http.DetectContentType(buf[:n])
+		}
+		h.Set("Content-Type", ctype)
+	}
+	h.Set("Accept-Ranges", "bytes")
+
+	var ranges []byteRange
+	// some clients send a Range with every request, which empty content
+	// answers in full rather than with 416
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" && size > 0 && ifRangeMatches(r, h.Get("ETag"), modtime) {
+		var err error
+		ranges, err = parseRange(rangeHeader, size)
+		if err != nil {
+			h.Set("Content-Range", "bytes */"+strconv.FormatInt(size, 10))
+			http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		// ranges adding up to more than the content are more expensive
+		// than the content itself
+		var total int64
+		for _, ra := range ranges {
+			total += ra.length
+		}
+		if total > size {
+			ranges = nil
+		}
+	}
+
+	switch len(ranges) {
+	case 0:
+		h.Set("Content-Length", strconv.FormatInt(size, 10))
+		w.WriteHeader(http.StatusOK)
+		if r.Method != "HEAD" {
+			io.Copy(w, io.NewSectionReader(content, 0, size))
+		}
+	case 1:
+		ra := ranges[0]
+		h.Set("Content-Range", ra.contentRange(size))
+		h.Set("Content-Length", strconv.FormatInt(ra.length, 10))
+		w.WriteHeader(http.StatusPartialContent)
+		if r.Method != "HEAD" {
+			io.Copy(w, io.NewSectionReader(content, ra.start, ra.length))
+		}
+	default:
+		mw := multipart.NewWriter(w)
+		length := multipartLength(mw.Boundary(), ranges, ctype, size)
+		h.Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+		h.Set("Content-Length", strconv.FormatInt(length, 10))
+		w.WriteHeader(http.StatusPartialContent)
+		if r.Method != "HEAD" {
+			writeRanges(mw, ranges, ctype, size, content)
+		}
+	}
+}
+
+// multipartLength returns the size of the multipart/byteranges body.
+func multipartLength(boundary string, ranges []byteRange, ctype string, size int64) int64 {
+	var cw countingWriter
+	mw := multipart.NewWriter(&cw)
+	mw.SetBoundary(boundary)
+	writeRanges(mw, ranges, ctype, size, nil)
+	for _, ra := range ranges {
+		cw += countingWriter(ra.length)
+	}
+	return int64(cw)
+}
+
+// writeRanges writes the parts of a multipart/byteranges body. Without
+// content, only the part headers are written.
+func writeRanges(mw *multipart.Writer, ranges []byteRange, ctype string, size int64, content io.ReaderAt) error {
+	for _, ra := range ranges {
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Range": {ra.contentRange(size)},
+			"Content-Type":  {ctype},
+		})
+		if err != nil {
+			return err
+		}
+		if content != nil {
+			if _, err := io.Copy(part, io.NewSectionReader(content, ra.start, ra.length)); err != nil {
+				return err
+			}
+		}
+	}
+	return mw.Close()
+}
+
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+type byteRange struct {
+	start, length int64
+}
+
+func (ra byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", ra.start, ra.start+ra.length-1, size)
+}
+
+// parseRange parses a "bytes=" Range header. Ranges beyond the end of the
+// content are dropped; if none is left, errUnsatisfiableRange is returned.
+// Other units are ignored, as RFC 7233 requires, by returning no ranges.
+func parseRange(s string, size int64) ([]byteRange, error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(s, prefix) {
+		return nil, nil
+	}
+	var ranges []byteRange
+	for _, spec := range strings.Split(s[len(prefix):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		i := strings.Index(spec, "-")
+		if i < 0 {
+			return nil, errInvalidRange
+		}
+		first, last := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+		var ra byteRange
+		if first == "" {
+			// suffix range: the last n bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errInvalidRange
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			ra = byteRange{start: size - n, length: n}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, errInvalidRange
+			}
+			if start >= size {
+				continue
+			}
+			end := size - 1
+			if last != "" {
+				end, err = strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return nil, errInvalidRange
+				}
+				if end >= size {
+					end = size - 1
+				}
+			}
+			ra = byteRange{start: start, length: end - start + 1}
+		}
+		ranges = append(ranges, ra)
+	}
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiableRange
+	}
+	return ranges, nil
+}
+
+// ifRangeMatches reports whether a Range request is to be honored.
+func ifRangeMatches(r *http.Request, etag string, modtime time.Time) bool {
+	ir := r.Header.Get("If-Range")
+	if ir == "" {
+		return true
+	}
+	if strings.HasPrefix(ir, `"`) || strings.HasPrefix(ir, "W/") {
+		// If-Range requires a strong comparison
+		return etag != "" && !strings.HasPrefix(etag, "W/") && ir == etag
+	}
+	t, err := http.ParseTime(ir)
+	return err == nil && !modtime.IsZero() && t.Equal(modtime.Truncate(time.Second))
+}
+
+// checkPreconditions evaluates the conditional request headers and returns
+// the status to answer with, or 0 to serve the content.
+func checkPreconditions(r *http.Request, etag string, modtime time.Time) int {
+	modtime = modtime.Truncate(time.Second)
+	if im := r.Header.Get("If-Match"); im != "" {
+		if !etagMatches(im, etag, true) {
+			return http.StatusPreconditionFailed
+		}
+	} else if ius := r.Header.Get("If-Unmodified-Since"); ius != "" && !modtime.IsZero() {
+		if t, err := http.ParseTime(ius); err == nil && modtime.After(t) {
+			return http.StatusPreconditionFailed
+		}
+	}
+	get := r.Method == "GET" || r.Method == "HEAD"
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etagMatches(inm, etag, false) {
+			if get {
+				return http.StatusNotModified
+			}
+			return http.StatusPreconditionFailed
+		}
+	} else if ims := r.Header.Get("If-Modified-Since"); ims != "" && get && !modtime.IsZero() {
+		if t, err := http.ParseTime(ims); err == nil && !modtime.After(t) {
+			return http.StatusNotModified
+		}
+	}
+	return 0
+}
+
+// etagMatches reports whether etag is in the list of a If-Match or
+// If-None-Match header.
+func etagMatches(list, etag string, strong bool) bool {
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.TrimSpace(tag)
+		// "*" matches any current representation, with an ETag or not
+		if tag == "*" {
+			return true
+		}
+		if etag == "" {
+			continue
+		}
+		if strong {
+			if !strings.HasPrefix(tag, "W/") && tag == etag {
+				return true
+			}
+		} else if strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// seekerAt implements io.ReaderAt on an io.ReadSeeker.
+type seekerAt struct {
+	mu sync.Mutex
+	rs io.ReadSeeker
+}
+
+func (s *seekerAt) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.rs.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(s.rs, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
@@ -0,0 +1,217 @@
+package vermouth
+
+import (
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var contentModTime = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func serveContentRequest(h http.HandlerFunc, method string, header map[string]string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, "/export", nil)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	h(rec, req)
+	return rec
+}
+
+func contentHandler(name, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		ServeContent(w, r, name, contentModTime, strings.NewReader(body))
+	}
+}
+
+func TestServeContentFull(t *testing.T) {
+	rec := serveContentRequest(contentHandler("export.csv", "a,b\n1,2\n"), "GET", nil)
+	expect(t, rec.Code, http.StatusOK)
+	expect(t, rec.Body.String(), "a,b\n1,2\n")
+	expect(t, rec.Header().Get("Accept-Ranges"), "bytes")
+	expect(t, rec.Header().Get("Content-Length"), "8")
+	expect(t, rec.Header().Get("Last-Modified"), "Thu, 02 Jan 2020 03:04:05 GMT")
+	expect(t, strings.HasPrefix(rec.Header().Get("Content-Type"), "text/csv"), true)
+
+	rec = serveContentRequest(contentHandler("export.csv", "a,b\n1,2\n"), "HEAD", nil)
+	expect(t, rec.Code, http.StatusOK)
+	expect(t, rec.Body.Len(), 0)
+	expect(t, rec.Header().Get("Content-Length"), "8")
+}
+
+func TestServeContentSniff(t *testing.T) {
+	rec := serveContentRequest(contentHandler("export", "<html><body>hi</body></html>"), "GET", nil)
+	expect(t, rec.Header().Get("Content-Type"), "text/html; charset=utf-8")
+
+	rec = serveContentRequest(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-custom")
+		ServeContent(w, r, "export", time.Time{}, strings.NewReader("data"))
+	}, "GET", nil)
+	expect(t, rec.Header().Get("Content-Type"), "application/x-custom")
+	expect(t, rec.Header().Get("Last-Modified"), "")
+}
+
+func TestServeContentSingleRange(t *testing.T) {
+	for _, tt := range []struct {
+		header, body, contentRange string
+	}{
+		{"bytes=0-4", "01234", "bytes 0-4/10"},
+		{"bytes=7-", "789", "bytes 7-9/10"},
+		{"bytes=-3", "789", "bytes 7-9/10"},
+		{"bytes=8-20", "89", "bytes 8-9/10"},
+		{"bytes=-20", "0123456789", "bytes 0-9/10"},
+		{"bytes=20-30, 2-3", "23", "bytes 2-3/10"},
+	} {
+		rec := serveContentRequest(contentHandler("data.bin", "0123456789"), "GET", map[string]string{"Range": tt.header})
+		expect(t, rec.Code, http.StatusPartialContent)
+		expect(t, rec.Body.String(), tt.body)
+		expect(t, rec.Header().Get("Content-Range"), tt.contentRange)
+	}
+}
+
+func TestServeContentUnsatisfiableRange(t *testing.T) {
+	for _, header := range []string{"bytes=10-", "bytes=5-2", "bytes=x-y", "bytes=-0"} {
+		rec := serveContentRequest(contentHandler("data.bin", "0123456789"), "GET", map[string]string{"Range": header})
+		expect(t, rec.Code, http.StatusRequestedRangeNotSatisfiable)
+		expect(t, rec.Header().Get("Content-Range"), "bytes */10")
+	}
+}
+
+func TestServeContentIgnoredRange(t *testing.T) {
+	for _, tt := range []struct {
+		header, body string
+	}{
+		{"lines=1-2", "0123456789"},
+		{"items=0-0", "0123456789"},
+	} {
+		rec := serveContentRequest(contentHandler("data.bin", tt.body), "GET", map[string]string{"Range": tt.header})
+		expect(t, rec.Code, http.StatusOK)
+		expect(t, rec.Body.String(), tt.body)
+		expect(t, rec.Header().Get("Content-Range"), "")
+	}
+
+	// empty content is served in full whatever the range
+	for _, header := range []string{"bytes=0-", "bytes=-1", "bytes=0-0, 5-"} {
+		rec := serveContentRequest(contentHandler("empty.bin", ""), "GET", map[string]string{"Range": header})
+		expect(t, rec.Code, http.StatusOK)
+		expect(t, rec.Body.Len(), 0)
+		expect(t, rec.Header().Get("Content-Length"), "0")
+		expect(t, rec.Header().Get("Content-Range"), "")
+	}
+}
+
+func TestServeContentMultiRange(t *testing.T) {
+	content := strings.NewReader("0123456789")
+	h := func(w http.ResponseWriter, r *http.Request) {
+		ServeReaderAt(w, r, "data.txt", contentModTime, content, content.Size())
+	}
+	ts := httptest.NewServer(http.HandlerFunc(h))
+	defer ts.Close()
+
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	req.Header.Set("Range", "bytes=0-1, 5-6, -1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	expect(t, resp.StatusCode, http.StatusPartialContent)
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	expect(t, err, nil)
+	expect(t, mediaType, "multipart/byteranges")
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	expect(t, resp.ContentLength, int64(len(body)))
+	mr := multipart.NewReader(strings.NewReader(string(body)), params["boundary"])
+	for _, want := range []struct{ contentRange, body string }{
+		{"bytes 0-1/10", "01"},
+		{"bytes 5-6/10", "56"},
+		{"bytes 9-9/10", "9"},
+	} {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect(t, part.Header.Get("Content-Range"), want.contentRange)
+		expect(t, strings.HasPrefix(part.Header.Get("Content-Type"), "text/plain"), true)
+		b, _ := ioutil.ReadAll(part)
+		expect(t, string(b), want.body)
+	}
+	_, err = mr.NextPart()
+	refute(t, err, nil)
+}
+
+func TestServeContentOverlappingRanges(t *testing.T) {
+	// ranges adding up to more than the content are answered in full
+	rec := serveContentRequest(contentHandler("data.bin", "0123456789"), "GET", map[string]string{"Range": "bytes=0-8, 1-9"})
+	expect(t, rec.Code, http.StatusOK)
+	expect(t, rec.Body.String(), "0123456789")
+}
+
+func TestServeContentIfRange(t *testing.T) {
+	for _, tt := range []struct {
+		ifRange string
+		status  int
+	}{
+		{`"v1"`, http.StatusPartialContent},
+		{`"v2"`, http.StatusOK},
+		{`W/"v1"`, http.StatusOK},
+		{contentModTime.Format(http.TimeFormat), http.StatusPartialContent},
+		{contentModTime.Add(-time.Hour).Format(http.TimeFormat), http.StatusOK},
+	} {
+		rec := serveContentRequest(contentHandler("data.bin", "0123456789"), "GET", map[string]string{
+			"Range":    "bytes=0-1",
+			"If-Range": tt.ifRange,
+		})
+		expect(t, rec.Code, tt.status)
+	}
+}
+
+func TestServeContentWithoutValidators(t *testing.T) {
+	h := func(w http.ResponseWriter, r *http.Request) {
+		ServeContent(w, r, "data.bin", time.Unix(0, 0), strings.NewReader("0123456789"))
+	}
+	for _, tt := range []struct {
+		header map[string]string
+		status int
+	}{
+		{map[string]string{"If-Match": "*"}, http.StatusOK},
+		{map[string]string{"If-Match": `"v1"`}, http.StatusPreconditionFailed},
+		{map[string]string{"If-None-Match": "*"}, http.StatusNotModified},
+		{map[string]string{"If-Modified-Since": time.Unix(0, 0).UTC().Format(http.TimeFormat)}, http.StatusOK},
+		{map[string]string{"If-Unmodified-Since": time.Unix(0, 0).UTC().Format(http.TimeFormat)}, http.StatusOK},
+		{map[string]string{"Range": "bytes=0-1", "If-Range": time.Unix(0, 0).UTC().Format(http.TimeFormat)}, http.StatusOK},
+	} {
+		rec := serveContentRequest(h, "GET", tt.header)
+		expect(t, rec.Code, tt.status)
+		expect(t, rec.Header().Get("Last-Modified"), "")
+	}
+}
+
+func TestServeContentPreconditions(t *testing.T) {
+	for _, tt := range []struct {
+		header map[string]string
+		status int
+	}{
+		{map[string]string{"If-None-Match": `"v1"`}, http.StatusNotModified},
+		{map[string]string{"If-None-Match": `W/"v1", "v0"`}, http.StatusNotModified},
+		{map[string]string{"If-None-Match": `"v0"`}, http.StatusOK},
+		{map[string]string{"If-Modified-Since": contentModTime.Format(http.TimeFormat)}, http.StatusNotModified},
+		{map[string]string{"If-Modified-Since": contentModTime.Add(-time.Hour).Format(http.TimeFormat)}, http.StatusOK},
+		{map[string]string{"If-Match": `"v0"`}, http.StatusPreconditionFailed},
+		{map[string]string{"If-Match": `"v1"`}, http.StatusOK},
+		{map[string]string{"If-Unmodified-Since": contentModTime.Add(-time.Hour).Format(http.TimeFormat)}, http.StatusPreconditionFailed},
+	} {
+		rec := serveContentRequest(contentHandler("data.bin", "0123456789"), "GET", tt.header)
+		expect(t, rec.Code, tt.status)
+		if tt.status == http.StatusNotModified {
+			expect(t, rec.Body.Len(), 0)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package vermouth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// CSRFTokenCtxKey is a key to be used when the CSRF token is bound to context object.
+var CSRFTokenCtxKey = "vermouth.CSRFToken"
+
+// CSRFErrorCtxKey is a key to be used when the reason of a CSRF failure is bound to context object.
+var CSRFErrorCtxKey = "vermouth.CSRFError"
+
+// Errors reported to the CSRF ErrorHandler.
+var (
+	ErrCSRFNoCookie   = errors.New("vermouth: CSRF cookie is missing")
+	ErrCSRFNoToken    = errors.New("vermouth: CSRF token is missing")
+	ErrCSRFBadToken   = errors.New("vermouth: CSRF token is invalid")
+	ErrCSRFBadOrigin  = errors.New("vermouth: request origin is not trusted")
+	ErrCSRFNoReferer  = errors.New("vermouth: referer is missing")
+	ErrCSRFBadReferer = errors.New("vermouth: referer is not trusted")
+)
+
+const (
+	csrfNonceLength     = 32
+	csrfSaltLength      = 16
+	csrfSignatureLength = sha256.Size
+)
+
+// CSRF is a middleware implementing the signed double-submit cookie pattern.
+//
+// A random nonce is stored in a cookie, and every page receives a token made
+// of a fresh salt and the HMAC of the salt and the nonce. Requests with unsafe
+// methods must send the token back in a header or form field, and must come
+// from a trusted origin.
+//
+// The origin of the request is the scheme and host resolved by RealIP when it
+// runs first, so that CSRF works behind a TLS terminating proxy.
+type CSRF struct {
+	secret []byte
+
+	// Name and attributes of the cookie holding the nonce.
+	CookieName   string
+	CookiePath   string
+	CookieDomain string
+	MaxAge       int
+	Secure       bool
+	SameSite     http.SameSite
+
+	// HeaderName and FieldName are where the token is looked up on unsafe requests.
+	HeaderName string
+	FieldName  string
+
+	// TrustedOrigins lists origins ("https://example.com") allowed in addition
+	// to the request's own host.
+	TrustedOrigins []string
+
+	// Exempt lists paths which are not checked. A pattern ending with "*"
+	// matches every path with that prefix.
+	Exempt []string
+
+	// Configurable http.Handler which is called when a request is rejected.
+	// The reason can be read with CSRFError. If it is not set, http.Error
+	// with http.StatusForbidden is used.
+	ErrorHandler http.Handler
+}
+
+// NewCSRF returns a new CSRF middleware signing tokens with secret.
+// The secret must be at least 32 bytes long.
+func NewCSRF(secret []byte) *CSRF {
+	if len(secret) < 32 {
+		panic("vermouth: CSRF secret must be at least 32 bytes")
+	}
+	return &CSRF{
+		secret:     secret,
+		CookieName: "_csrf",
+		CookiePath: "/",
+		MaxAge:     12 * 60 * 60,
+		SameSite:   http.SameSiteLaxMode,
+		HeaderName: "X-CSRF-Token",
+		FieldName:  "csrf_token",
+	}
+}
+
+// CSRFToken returns the CSRF token bound to ctx for embedding into forms,
+// or an empty string.
+func CSRFToken(ctx context.Context) string {
+	token, _ := ctx.Value(CSRFTokenCtxKey).(string)
+	return token
+}
+
+// CSRFError returns the reason why the CSRF middleware rejected a request.
+func CSRFError(ctx context.Context) error {
+	err, _ := ctx.Value(CSRFErrorCtxKey).(error)
+	return err
+}
+
+func (c *CSRF) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	w.Header().Add("Vary", "Cookie")
+
+	nonce := c.readNonce(r)
+	if nonce == nil {
+		nonce = make([]byte, csrfNonceLength)
+		if _, err := rand.Read(nonce); err != nil {
+			panic(err)
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     c.CookieName,
+			Value:    base64.RawURLEncoding.EncodeToString(nonce),
+			Path:     c.CookiePath,
+			Domain:   c.CookieDomain,
+			MaxAge:   c.MaxAge,
+			Secure:   c.Secure,
+			HttpOnly: true,
+			SameSite: c.SameSite,
+		})
+		if !isSafeMethod(r.Method) && !c.exempt(r.URL.Path) {
+			c.reject(w, r, ErrCSRFNoCookie)
+			return
+		}
+	} else if !isSafeMethod(r.Method) && !c.exempt(r.URL.Path) {
+		if err := c.check(r, nonce); err != nil {
+			c.reject(w, r, err)
+			return
+		}
+	}
+
+	next(w, r.WithContext(context.WithValue(r.Context(), CSRFTokenCtxKey, c.sign(nonce))))
+}
+
+func (c *CSRF) check(r *http.Request, nonce []byte) error {
+	if err := c.checkOrigin(r); err != nil {
+		return err
+	}
+	token := r.Header.Get(c.HeaderName)
+	if token == "" {
+		token = r.PostFormValue(c.FieldName)
+	}
+	if token == "" {
+		return ErrCSRFNoToken
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(raw) != csrfSaltLength+csrfSignatureLength {
+		return ErrCSRFBadToken
+	}
+	if !hmac.Equal(raw[csrfSaltLength:], c.mac(raw[:csrfSaltLength], nonce)) {
+		return ErrCSRFBadToken
+	}
+	return nil
+}
+
+func (c *CSRF) checkOrigin(r *http.Request) error {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if origin == "null" || !c.trusted(r, origin) {
+			return ErrCSRFBadOrigin
+		}
+		return nil
+	}
+	// Browsers may omit Origin; fall back to Referer, which is mandatory over
+	// TLS where it cannot be stripped by intermediaries.
+	referer := r.Header.Get("Referer")
+	if referer == "" {
+		if scheme, _ := requestOrigin(r); scheme == "https" {
+			return ErrCSRFNoReferer
+		}
+		return nil
+	}
+	u, err := url.Parse(referer)
+	if err != nil || !c.trusted(r, u.Scheme+"://"+u.Host) {
+		return ErrCSRFBadReferer
+	}
+	return nil
+}
+
+func (c *CSRF) trusted(r *http.Request, origin string) bool {
+	scheme, host := requestOrigin(r)
+	if strings.EqualFold(origin, scheme+"://"+host) {
+		return true
+	}
+	for _, o := range c.TrustedOrigins {
+		if strings.EqualFold(origin, o) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestOrigin returns the scheme and host requested by the client. Behind
+// a TLS terminating proxy they are those resolved by RealIP.
+func requestOrigin(r *http.Request) (scheme, host string) {
+	if addr := GetClientAddr(r.Context()); addr != nil && addr.Scheme != "" {
+		return addr.Scheme, addr.Host
+	}
+	if r.TLS != nil {
+		return "https", r.Host
+	}
+	return "http", r.Host
+}
+
+func (c *CSRF) exempt(path string) bool {
+	for _, pattern := range c.Exempt {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(path, pattern[:len(pattern)-1]) {
+				return true
+			}
+		} else if path == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CSRF) reject(w http.ResponseWriter, r *http.Request, err error) {
+	if c.ErrorHandler != nil {
+		c.ErrorHandler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), CSRFErrorCtxKey, err)))
+		return
+	}
+	http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+}
+
+func (c *CSRF) readNonce(r *http.Request) []byte {
+	cookie, err := r.Cookie(c.CookieName)
+	if err != nil {
+		return nil
+	}
+	nonce, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil || len(nonce) != csrfNonceLength {
+		return nil
+	}
+	return nonce
+}
+
+// sign returns a fresh token for nonce. The random salt makes every token
+// different, so the token cannot be recovered by compression side channels.
+func (c *CSRF) sign(nonce []byte) string {
+	salt := make([]byte, csrfSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(append(salt, c.mac(salt, nonce)...))
+}
+
+func (c *CSRF) mac(salt, nonce []byte) []byte {
+	m := hmac.New(sha256.New, c.secret)
+	m.Write(salt)
+	m.Write(nonce)
+	return m.Sum(nil)
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	return false
+}
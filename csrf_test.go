@@ -0,0 +1,115 @@
+package vermouth
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRF(t *testing.T) {
+	csrf := NewCSRF([]byte("0123456789abcdef0123456789abcdef"))
+	csrf.Exempt = []string{"/hooks/*"}
+	csrf.ErrorHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, CSRFError(r.Context()).Error(), http.StatusForbidden)
+	})
+
+	vm := New()
+	vm.Use("/", csrf)
+	vm.Get("/form", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, CSRFToken(r.Context()))
+	})
+	vm.Post("/form", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	})
+	vm.Post("/hooks/github", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hook")
+	})
+
+	rec := httptest.NewRecorder()
+	vm.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/form", nil))
+	expect(t, rec.Code, http.StatusOK)
+	cookies := rec.Result().Cookies()
+	expect(t, len(cookies), 1)
+	token := rec.Body.String()
+	refute(t, token, "")
+
+	post := func(token, origin string, withCookie bool) *httptest.ResponseRecorder {
+		form := url.Values{"csrf_token": {token}}
+		req := httptest.NewRequest("POST", "http://example.com/form", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if withCookie {
+			req.AddCookie(cookies[0])
+		}
+		rec := httptest.NewRecorder()
+		vm.ServeHTTP(rec, req)
+		return rec
+	}
+
+	expect(t, post(token, "http://example.com", true).Code, http.StatusOK)
+	expect(t, post(token, "", true).Code, http.StatusOK)
+
+	rec = post(token, "http://evil.com", true)
+	expect(t, rec.Code, http.StatusForbidden)
+	expect(t, strings.TrimSpace(rec.Body.String()), ErrCSRFBadOrigin.Error())
+
+	rec = post(token, "", false)
+	expect(t, rec.Code, http.StatusForbidden)
+	expect(t, strings.TrimSpace(rec.Body.String()), ErrCSRFNoCookie.Error())
+
+	rec = post("", "", true)
+	expect(t, strings.TrimSpace(rec.Body.String()), ErrCSRFNoToken.Error())
+
+	rec = post(token[:len(token)-2]+"AA", "", true)
+	expect(t, strings.TrimSpace(rec.Body.String()), ErrCSRFBadToken.Error())
+
+	rec = httptest.NewRecorder()
+	vm.ServeHTTP(rec, httptest.NewRequest("POST", "http://example.com/hooks/github", nil))
+	expect(t, rec.Code, http.StatusOK)
+}
+
+func TestCSRFBehindTLSProxy(t *testing.T) {
+	csrf := NewCSRF([]byte("0123456789abcdef0123456789abcdef"))
+	vm := New()
+	vm.Use("/", NewRealIP("192.0.2.0/24"))
+	vm.Use("/", csrf)
+	vm.Get("/form", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, CSRFToken(r.Context()))
+	})
+	vm.Post("/form", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	})
+
+	rec := httptest.NewRecorder()
+	vm.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/form", nil))
+	cookie := rec.Result().Cookies()[0]
+	token := rec.Body.String()
+
+	post := func(origin, referer, proto string) int {
+		req := httptest.NewRequest("POST", "http://example.com/form", nil)
+		req.Header.Set("X-CSRF-Token", token)
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+		req.Header.Set("X-Forwarded-Proto", proto)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if referer != "" {
+			req.Header.Set("Referer", referer)
+		}
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		vm.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	expect(t, post("https://example.com", "", "https"), http.StatusOK)
+	expect(t, post("http://example.com", "", "https"), http.StatusForbidden)
+	expect(t, post("", "https://example.com/form", "https"), http.StatusOK)
+	// Referer is mandatory when the client used https
+	expect(t, post("", "", "https"), http.StatusForbidden)
+	expect(t, post("http://example.com", "", "http"), http.StatusOK)
+}
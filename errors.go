@@ -0,0 +1,94 @@
+package vermouth
+
+import (
+	"net/http"
+	"strings"
+)
+
+// StatusCoder is implemented by errors which carry an HTTP status code.
+type StatusCoder interface {
+	StatusCode() int
+}
+
+// HTTPError is an error with an HTTP status code and a message which is safe
+// to show to clients.
+type HTTPError struct {
+	Code    int
+	Message string
+	// Err is the underlying error, which is not sent to clients.
+	Err error
+}
+
+// NewHTTPError returns an HTTPError. The message defaults to the status text.
+func NewHTTPError(code int, message string) *HTTPError {
+	if message == "" {
+		message = http.StatusText(code)
+	}
+	return &HTTPError{Code: code, Message: message}
+}
+
+func (e *HTTPError) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+// StatusCode implements StatusCoder.
+func (e *HTTPError) StatusCode() int {
+	return e.Code
+}
+
+// Unwrap returns the underlying error.
+func (e *HTTPError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorHandlerFunc is an adapter to allow the use of functions returning an
+// error as handlers. A returned error is written with WriteError.
+type ErrorHandlerFunc func(w http.ResponseWriter, r *http.Request) error
+
+func (f ErrorHandlerFunc) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := f(w, r); err != nil {
+		WriteError(w, r, err)
+	}
+}
+
+type fieldErrors interface {
+	FieldErrors() []*FieldError
+}
+
+type errorBody struct {
+	Status int           `json:"status"`
+	Error  string        `json:"error"`
+	Fields []*FieldError `json:"fields,omitempty"`
+}
+
+// WriteError writes err as an HTTP error response.
+//
+// The status code is taken from a StatusCoder and defaults to 500, in which
+// case the error message is not disclosed. Errors listing field errors, and
+// requests accepting JSON, receive a JSON body.
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	code := http.StatusInternalServerError
+	message := http.StatusText(code)
+	if sc, ok := err.(StatusCoder); ok {
+		code = sc.StatusCode()
+		message = err.Error()
+		if he, ok := err.(*HTTPError); ok {
+			message = he.Message
+		}
+	}
+
+	var fields []*FieldError
+	if fe, ok := err.(fieldErrors); ok {
+		fields = fe.FieldErrors()
+	}
+	if fields == nil && !strings.Contains(r.Header.Get("Accept"), "json") {
+		http.Error(w, message, code)
+		return
+	}
+
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	JSON(w, code, errorBody{Status: code, Error: message, Fields: fields})
+}
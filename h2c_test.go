@@ -0,0 +1,89 @@
+package vermouth
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func h2cClient() *http.Client {
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{Transport: &http.Transport{Protocols: protocols}}
+}
+
+func getProto(t *testing.T, c *http.Client, url string) string {
+	resp, err := c.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	expect(t, resp.Proto, string(body))
+	return string(body)
+}
+
+func TestH2C(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	url, _ := serveTestApp(t, ctx, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}, func(o *Options) {
+		o.H2C = true
+	})
+
+	expect(t, getProto(t, h2cClient(), url), "HTTP/2.0")
+	expect(t, getProto(t, &http.Client{Transport: &http.Transport{}}, url), "HTTP/1.1")
+}
+
+func TestH2CUpgradeIsServedOverHTTP1(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	url, _ := serveTestApp(t, ctx, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}, func(o *Options) {
+		o.H2C = true
+	})
+
+	conn, err := net.Dial("tcp", strings.TrimSuffix(strings.TrimPrefix(url, "http://"), "/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABkAARAAAAAAAIAAAAA\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	expect(t, resp.StatusCode, http.StatusOK)
+	expect(t, string(body), "HTTP/1.1")
+}
+
+func TestH2CDisabled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	url, _ := serveTestApp(t, ctx, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}, nil)
+
+	if _, err := h2cClient().Get(url); err == nil {
+		t.Fatal("expected prior knowledge HTTP/2 to fail without H2C")
+	}
+}
+
+func TestNewServerHTTP2Config(t *testing.T) {
+	vm := New()
+	vm.Options.H2C = true
+	vm.Options.HTTP2 = &http.HTTP2Config{MaxConcurrentStreams: 10, MaxReadFrameSize: 1 << 20}
+	srv := vm.NewServer()
+	expect(t, srv.HTTP2, vm.Options.HTTP2)
+	expect(t, srv.Protocols.HTTP1(), true)
+	expect(t, srv.Protocols.HTTP2(), true)
+	expect(t, srv.Protocols.UnencryptedHTTP2(), true)
+}
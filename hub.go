@@ -0,0 +1,469 @@
+package vermouth
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// ErrSlowConsumer is the Err of a Subscriber disconnected because its
+	// queue was full.
+	ErrSlowConsumer = errors.New("vermouth: subscriber too slow")
+
+	// ErrHubClosed is the Err of the Subscribers of a closed Hub.
+	ErrHubClosed = errors.New("vermouth: hub closed")
+
+	// ErrSubscriberClosed is returned when subscribing a closed Subscriber.
+	ErrSubscriberClosed = errors.New("vermouth: subscriber closed")
+)
+
+// DefaultQueueSize is the QueueSize of new Hubs.
+var DefaultQueueSize = 64
+
+// SlowConsumerPolicy decides what happens when a message is published to a
+// Subscriber whose queue is full.
+type SlowConsumerPolicy int
+
+const (
+	// DropNewest discards the published message.
+	DropNewest SlowConsumerPolicy = iota
+	// DropOldest discards the oldest queued message to make room.
+	DropOldest
+	// Disconnect closes the Subscriber with ErrSlowConsumer.
+	Disconnect
+)
+
+// Message is a message published to a topic.
+type Message struct {
+	Topic string
+	Data  []byte
+}
+
+// Broker carries messages between the hubs of several processes, e.g. over
+// Redis or NATS. Messages published to a Broker must be delivered to the
+// functions subscribed to their topic in every process, including the
+// publishing one.
+type Broker interface {
+	Publish(msg Message) error
+	// Subscribe starts delivering the messages of topic to deliver. It is
+	// called once per topic, when the topic gets its first local subscriber.
+	Subscribe(topic string, deliver func(Message)) error
+	// Unsubscribe stops delivering the messages of topic.
+	Unsubscribe(topic string) error
+}
+
+// Hub fans messages out to subscribers by topic, e.g. to the clients of
+// EventStreams and WebSockets. Without a Broker, messages are delivered
+// within the process. The zero value is ready to use; the fields must not be
+// changed after the first subscription.
+//
+// Every Subscriber has a queue of QueueSize messages, DefaultQueueSize if
+// zero, so that one slow client does not hold up the others; Policy decides
+// what happens when it is full.
+type Hub struct {
+	QueueSize int
+	Policy    SlowConsumerPolicy
+	Broker    Broker
+
+	mu     sync.RWMutex
+	topics map[string]*hubTopic
+	subs   map[*Subscriber]struct{}
+	closed bool
+}
+
+// hubTopic holds the subscribers of a topic. Its lock serializes the Broker
+// calls of the topic, so that they reach the Broker in the order in which
+// the first subscriber joined and the last one left.
+type hubTopic struct {
+	mu         sync.Mutex
+	subs       map[*Subscriber]struct{}
+	pending    int
+	subscribed bool
+}
+
+// NewHub returns a Hub delivering messages within the process.
+func NewHub() *Hub {
+	return &Hub{QueueSize: DefaultQueueSize}
+}
+
+// Attach closes the hub when a server started with opts begins to shut
+// down, in addition to any ShutdownInitiated function already set, so that
+// subscribers can say goodbye to their clients.
+func (h *Hub) Attach(opts *Options) {
+	prev := opts.ShutdownInitiated
+	opts.ShutdownInitiated = func() {
+		if prev != nil {
+			prev()
+		}
+		h.Close()
+	}
+}
+
+// Subscribe returns a Subscriber to the given topics.
+func (h *Hub) Subscribe(topics ...string) (*Subscriber, error) {
+	size := h.QueueSize
+	if size <= 0 {
+		size = DefaultQueueSize
+	}
+	s := &Subscriber{
+		hub:    h,
+		ch:     make(chan Message, size),
+		done:   make(chan struct{}),
+		topics: make(map[string]struct{}),
+	}
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return nil, ErrHubClosed
+	}
+	if h.subs == nil {
+		h.subs = make(map[*Subscriber]struct{})
+	}
+	h.subs[s] = struct{}{}
+	h.mu.Unlock()
+	if err := s.Subscribe(topics...); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Publish publishes data to topic.
+func (h *Hub) Publish(topic string, data []byte) error {
+	msg := Message{Topic: topic, Data: data}
+	if h.Broker != nil {
+		return h.Broker.Publish(msg)
+	}
+	h.deliver(msg)
+	return nil
+}
+
+func (h *Hub) deliver(msg Message) {
+	h.mu.RLock()
+	var subs []*Subscriber
+	if t := h.topics[msg.Topic]; t != nil {
+		subs = make([]*Subscriber, 0, len(t.subs))
+		for s := range t.subs {
+			subs = append(subs, s)
+		}
+	}
+	h.mu.RUnlock()
+	for _, s := range subs {
+		s.enqueue(msg)
+	}
+}
+
+// Count returns the number of subscribers to topic.
+func (h *Hub) Count(topic string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if t := h.topics[topic]; t != nil {
+		return len(t.subs)
+	}
+	return 0
+}
+
+// Presence returns the number of subscribers of every topic which has any.
+func (h *Hub) Presence() map[string]int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	presence := make(map[string]int, len(h.topics))
+	for topic, t := range h.topics {
+		if len(t.subs) > 0 {
+			presence[topic] = len(t.subs)
+		}
+	}
+	return presence
+}
+
+// Close closes every Subscriber with ErrHubClosed. Later subscriptions fail.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	h.closed = true
+	subs := make([]*Subscriber, 0, len(h.subs))
+	for s := range h.subs {
+		subs = append(subs, s)
+	}
+	h.mu.Unlock()
+	for _, s := range subs {
+		s.close(ErrHubClosed)
+	}
+}
+
+// Subscriber receives the messages published to its topics.
+type Subscriber struct {
+	hub     *Hub
+	ch      chan Message
+	done    chan struct{}
+	dropped uint64
+
+	mu     sync.Mutex
+	topics map[string]struct{}
+	closed bool
+	err    error
+}
+
+// Messages returns the queue of the subscriber. It is closed, after the
+// queued messages, when the subscriber is closed.
+func (s *Subscriber) Messages() <-chan Message {
+	return s.ch
+}
+
+// Done returns a channel which is closed when the subscriber is closed.
+func (s *Subscriber) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns why the subscriber was closed: ErrSlowConsumer, ErrHubClosed,
+// or nil if it was closed by Close or is still open.
+func (s *Subscriber) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Dropped returns the number of messages discarded because the queue was full.
+func (s *Subscriber) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Topics returns the topics of the subscriber.
+func (s *Subscriber) Topics() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	topics := make([]string, 0, len(s.topics))
+	for topic := range s.topics {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// Subscribe adds topics to the subscriber.
+func (s *Subscriber) Subscribe(topics ...string) error {
+	for _, topic := range topics {
+		s.mu.Lock()
+		closed := s.closed
+		_, joined := s.topics[topic]
+		s.mu.Unlock()
+		if closed {
+			return ErrSubscriberClosed
+		}
+		if joined {
+			continue
+		}
+		if err := s.hub.join(s, topic); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Unsubscribe removes topics from the subscriber.
+func (s *Subscriber) Unsubscribe(topics ...string) error {
+	var err error
+	for _, topic := range topics {
+		s.mu.Lock()
+		delete(s.topics, topic)
+		s.mu.Unlock()
+		if e := s.hub.leave(s, topic); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// acquire returns the topic, creating it if needed, and counts a pending
+// join or leave so that it is not removed meanwhile.
+func (h *Hub) acquire(topic string) *hubTopic {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.topics == nil {
+		h.topics = make(map[string]*hubTopic)
+	}
+	t := h.topics[topic]
+	if t == nil {
+		t = &hubTopic{subs: make(map[*Subscriber]struct{})}
+		h.topics[topic] = t
+	}
+	t.pending++
+	return t
+}
+
+// release ends a pending join or leave; t.mu must be held. When the topic
+// has no subscribers left, it is unsubscribed from the Broker and removed.
+func (h *Hub) release(topic string, t *hubTopic) error {
+	h.mu.Lock()
+	last := len(t.subs) == 0 && t.pending == 1
+	h.mu.Unlock()
+	var err error
+	if last && t.subscribed {
+		if err = h.Broker.Unsubscribe(topic); err == nil {
+			t.subscribed = false
+		}
+	}
+	h.mu.Lock()
+	t.pending--
+	if t.pending == 0 && len(t.subs) == 0 && !t.subscribed {
+		delete(h.topics, topic)
+	}
+	h.mu.Unlock()
+	return err
+}
+
+// join adds s to topic, subscribing to the Broker when it is the first
+// subscriber. A failed Broker subscription leaves no trace.
+func (h *Hub) join(s *Subscriber, topic string) error {
+	t := h.acquire(topic)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if h.Broker != nil && !t.subscribed {
+		if err := h.Broker.Subscribe(topic, h.deliver); err != nil {
+			h.release(topic, t)
+			return err
+		}
+		t.subscribed = true
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		h.release(topic, t)
+		return ErrSubscriberClosed
+	}
+	h.mu.Lock()
+	t.subs[s] = struct{}{}
+	h.mu.Unlock()
+	s.topics[topic] = struct{}{}
+	s.mu.Unlock()
+	return h.release(topic, t)
+}
+
+// leave removes s from topic, unsubscribing from the Broker when it was the
+// last subscriber.
+func (h *Hub) leave(s *Subscriber, topic string) error {
+	h.mu.Lock()
+	t := h.topics[topic]
+	if t == nil {
+		h.mu.Unlock()
+		return nil
+	}
+	if _, ok := t.subs[s]; !ok {
+		h.mu.Unlock()
+		return nil
+	}
+	delete(t.subs, s)
+	t.pending++
+	h.mu.Unlock()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return h.release(topic, t)
+}
+
+// Close unsubscribes from every topic and closes the queue.
+func (s *Subscriber) Close() {
+	s.close(nil)
+}
+
+func (s *Subscriber) close(err error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.err = err
+	topics := s.topics
+	s.topics = make(map[string]struct{})
+	close(s.ch)
+	close(s.done)
+	s.mu.Unlock()
+
+	h := s.hub
+	for topic := range topics {
+		h.leave(s, topic)
+	}
+	h.mu.Lock()
+	delete(h.subs, s)
+	h.mu.Unlock()
+}
+
+func (s *Subscriber) enqueue(msg Message) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	select {
+	case s.ch <- msg:
+		s.mu.Unlock()
+		return
+	default:
+	}
+	switch s.hub.Policy {
+	case DropOldest:
+		select {
+		case <-s.ch:
+		default:
+		}
+		s.ch <- msg
+		atomic.AddUint64(&s.dropped, 1)
+	case Disconnect:
+		s.mu.Unlock()
+		s.close(ErrSlowConsumer)
+		return
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+	s.mu.Unlock()
+}
+
+// StreamEvents sends the messages of the subscriber as events named after
+// their topic until the subscriber or the stream is closed. When the hub is
+// closed or the server shuts down, a final "shutdown" event tells the client
+// to reconnect later.
+func (s *Subscriber) StreamEvents(sse *EventStream) error {
+	shutdown := Event{Event: "shutdown"}
+	for {
+		select {
+		case msg, ok := <-s.ch:
+			if !ok {
+				if s.Err() == ErrHubClosed {
+					sse.final(shutdown)
+				}
+				return s.Err()
+			}
+			if err := sse.Send(msg.Topic, "", string(msg.Data)); err != nil {
+				return err
+			}
+		case <-sse.Done():
+			// the request context is cancelled when the server shuts
+			// down, which may close the stream before the hub
+			if sse.r.Context().Err() != nil {
+				sse.final(shutdown)
+			}
+			return ErrStreamClosed
+		}
+	}
+}
+
+// StreamWebSocket writes the messages of the subscriber to ws as messages of
+// the given type until the subscriber is closed or a write fails. When the
+// hub is closed, the close handshake is started with CloseGoingAway, and
+// when the subscriber is too slow with ClosePolicyViolation.
+func (s *Subscriber) StreamWebSocket(ws *WebSocket, messageType int) error {
+	for msg := range s.ch {
+		if err := ws.WriteMessage(messageType, msg.Data); err != nil {
+			return err
+		}
+	}
+	switch err := s.Err(); err {
+	case ErrHubClosed:
+		ws.WriteClose(CloseGoingAway, "server shutting down")
+		return err
+	case ErrSlowConsumer:
+		ws.WriteClose(ClosePolicyViolation, "too slow")
+		return err
+	}
+	return nil
+}
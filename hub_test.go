@@ -0,0 +1,317 @@
+package vermouth
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, s *Subscriber) Message {
+	select {
+	case msg := <-s.Messages():
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+	return Message{}
+}
+
+func TestHubPublish(t *testing.T) {
+	hub := NewHub()
+	a, err := hub.Subscribe("news", "sports")
+	expect(t, err, nil)
+	b, _ := hub.Subscribe("news")
+	expect(t, hub.Count("news"), 2)
+	expect(t, hub.Count("sports"), 1)
+	expect(t, hub.Count("weather"), 0)
+
+	hub.Publish("news", []byte("hello"))
+	hub.Publish("weather", []byte("sunny"))
+	hub.Publish("sports", []byte("goal"))
+	expect(t, string(receive(t, a).Data), "hello")
+	msg := receive(t, a)
+	expect(t, msg.Topic, "sports")
+	expect(t, string(msg.Data), "goal")
+	expect(t, string(receive(t, b).Data), "hello")
+	expect(t, len(b.Messages()), 0)
+
+	a.Unsubscribe("news")
+	expect(t, hub.Count("news"), 1)
+	topics := a.Topics()
+	expect(t, len(topics), 1)
+	expect(t, topics[0], "sports")
+
+	b.Close()
+	_, ok := <-b.Messages()
+	expect(t, ok, false)
+	expect(t, b.Err(), nil)
+	expect(t, b.Subscribe("news"), ErrSubscriberClosed)
+	expect(t, hub.Presence()["news"], 0)
+	expect(t, hub.Presence()["sports"], 1)
+}
+
+func TestHubSlowConsumerPolicies(t *testing.T) {
+	for _, tt := range []struct {
+		policy  SlowConsumerPolicy
+		want    []string
+		dropped uint64
+		err     error
+	}{
+		{DropNewest, []string{"1", "2"}, 1, nil},
+		{DropOldest, []string{"2", "3"}, 1, nil},
+		{Disconnect, []string{"1", "2"}, 0, ErrSlowConsumer},
+	} {
+		hub := NewHub()
+		hub.QueueSize = 2
+		hub.Policy = tt.policy
+		s, _ := hub.Subscribe("t")
+		for _, data := range []string{"1", "2", "3"} {
+			hub.Publish("t", []byte(data))
+		}
+		var got []string
+		for len(got) < 2 {
+			got = append(got, string(receive(t, s).Data))
+		}
+		expect(t, got[0], tt.want[0])
+		expect(t, got[1], tt.want[1])
+		expect(t, s.Dropped(), tt.dropped)
+		expect(t, s.Err(), tt.err)
+		if tt.policy == Disconnect {
+			expect(t, hub.Count("t"), 0)
+			<-s.Done()
+		}
+	}
+}
+
+func TestHubClose(t *testing.T) {
+	var hub Hub
+	s, err := hub.Subscribe("t")
+	expect(t, err, nil)
+	hub.Publish("t", []byte("zero"))
+	expect(t, string(receive(t, s).Data), "zero")
+
+	hub.Close()
+	<-s.Done()
+	expect(t, s.Err(), ErrHubClosed)
+	expect(t, hub.Count("t"), 0)
+	_, err = hub.Subscribe("t")
+	expect(t, err, ErrHubClosed)
+}
+
+func TestHubAttach(t *testing.T) {
+	hub := NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	var called int32
+	url, errc := serveTestApp(t, ctx, func(w http.ResponseWriter, r *http.Request) {
+		s, err := hub.Subscribe("t")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		defer s.Close()
+		sse := NewEventStream(w, r)
+		sse.Open()
+		s.StreamEvents(sse)
+	}, func(o *Options) {
+		o.GracefulTimeout = 5 * time.Second
+		o.ShutdownInitiated = func() { atomic.AddInt32(&called, 1) }
+		hub.Attach(o)
+	})
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	for hub.Count("t") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	events := readEvents(t, bufio.NewReader(resp.Body), 1)
+	expect(t, events[0], "event: shutdown\ndata: \n")
+	expect(t, <-errc, nil)
+	expect(t, atomic.LoadInt32(&called), int32(1))
+	_, err = hub.Subscribe("t")
+	expect(t, err, ErrHubClosed)
+}
+
+// memoryBroker connects the hubs of a test as if they ran in separate processes.
+type memoryBroker struct {
+	mu       sync.Mutex
+	handlers map[string][]func(Message)
+	log      []string
+	err      error
+}
+
+type memoryBrokerClient struct {
+	b *memoryBroker
+}
+
+func (c memoryBrokerClient) Publish(msg Message) error {
+	c.b.mu.Lock()
+	handlers := append([]func(Message){}, c.b.handlers[msg.Topic]...)
+	c.b.mu.Unlock()
+	for _, h := range handlers {
+		h(msg)
+	}
+	return nil
+}
+
+func (c memoryBrokerClient) Subscribe(topic string, deliver func(Message)) error {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	if c.b.err != nil {
+		return c.b.err
+	}
+	c.b.handlers[topic] = append(c.b.handlers[topic], deliver)
+	c.b.log = append(c.b.log, "subscribe "+topic)
+	return nil
+}
+
+func (c memoryBrokerClient) Unsubscribe(topic string) error {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	c.b.log = append(c.b.log, "unsubscribe "+topic)
+	return nil
+}
+
+func TestHubBroker(t *testing.T) {
+	broker := &memoryBroker{handlers: make(map[string][]func(Message))}
+	hub1, hub2 := NewHub(), NewHub()
+	hub1.Broker = memoryBrokerClient{broker}
+	hub2.Broker = memoryBrokerClient{broker}
+
+	s1, _ := hub1.Subscribe("t")
+	s2, _ := hub2.Subscribe("t")
+	s3, _ := hub2.Subscribe("t")
+	hub1.Publish("t", []byte("across"))
+	expect(t, string(receive(t, s1).Data), "across")
+	expect(t, string(receive(t, s2).Data), "across")
+	expect(t, string(receive(t, s3).Data), "across")
+
+	s2.Close()
+	s3.Unsubscribe("t")
+	log := append([]string{}, broker.log...)
+	sort.Strings(log)
+	expect(t, len(log), 3)
+	expect(t, log[0], "subscribe t")
+	expect(t, log[1], "subscribe t")
+	expect(t, log[2], "unsubscribe t")
+}
+
+func TestHubBrokerSubscribeFails(t *testing.T) {
+	broker := &memoryBroker{handlers: make(map[string][]func(Message)), err: errors.New("unavailable")}
+	hub := NewHub()
+	hub.Broker = memoryBrokerClient{broker}
+
+	_, err := hub.Subscribe("t")
+	expect(t, err, broker.err)
+	expect(t, hub.Count("t"), 0)
+	expect(t, len(broker.log), 0)
+
+	broker.err = nil
+	s, err := hub.Subscribe("t")
+	expect(t, err, nil)
+	expect(t, hub.Count("t"), 1)
+	s.Close()
+	expect(t, len(broker.log), 2)
+	expect(t, broker.log[0], "subscribe t")
+	expect(t, broker.log[1], "unsubscribe t")
+}
+
+func TestHubBrokerConcurrentSubscribers(t *testing.T) {
+	broker := &memoryBroker{handlers: make(map[string][]func(Message))}
+	hub := NewHub()
+	hub.Broker = memoryBrokerClient{broker}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				s, err := hub.Subscribe("t")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				s.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	expect(t, hub.Count("t"), 0)
+	// the broker calls of a topic alternate, ending unsubscribed
+	for i, entry := range broker.log {
+		if i%2 == 0 {
+			expect(t, entry, "subscribe t")
+		} else {
+			expect(t, entry, "unsubscribe t")
+		}
+	}
+	expect(t, len(broker.log)%2, 0)
+}
+
+func TestHubStreamEvents(t *testing.T) {
+	hub := NewHub()
+	subscribed := make(chan struct{})
+	vm := New()
+	vm.Get("/events", func(w http.ResponseWriter, r *http.Request) {
+		s, err := hub.Subscribe(r.URL.Query().Get("topic"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		defer s.Close()
+		sse := NewEventStream(w, r)
+		sse.Open()
+		close(subscribed)
+		s.StreamEvents(sse)
+	})
+	ts := httptest.NewServer(vm)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/events?topic=chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	<-subscribed
+	hub.Publish("chat", []byte("hi"))
+	hub.Close()
+	events := readEvents(t, bufio.NewReader(resp.Body), 2)
+	expect(t, events[0], "event: chat\ndata: hi\n")
+	expect(t, events[1], "event: shutdown\ndata: \n")
+}
+
+func TestHubStreamWebSocket(t *testing.T) {
+	hub := NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	url, _ := serveTestApp(t, ctx, WebSocketHandler(nil, func(ws *WebSocket, r *http.Request) {
+		s, err := hub.Subscribe("chat")
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		s.StreamWebSocket(ws, TextMessage)
+	}), hub.Attach)
+	c := dialWebSocket(t, url, nil)
+	defer c.conn.Close()
+	for hub.Count("chat") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	hub.Publish("chat", []byte("hi"))
+	b0, payload := c.readFrame()
+	expect(t, b0, byte(0x80|TextMessage))
+	expect(t, string(payload), "hi")
+	cancel()
+	expect(t, c.readClose(), CloseGoingAway)
+}
@@ -0,0 +1,719 @@
+package vermouth
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JWTClaimsCtxKey is a key to be used when verified JWT claims are bound to context object.
+var JWTClaimsCtxKey = "vermouth.JWTClaims"
+
+// Errors returned while verifying a JWT.
+var (
+	ErrTokenMissing     = errors.New("vermouth: token is missing")
+	ErrTokenMalformed   = errors.New("vermouth: token is malformed")
+	ErrTokenSignature   = errors.New("vermouth: token signature is invalid")
+	ErrTokenAlgorithm   = errors.New("vermouth: token algorithm is not allowed")
+	ErrTokenExpired     = errors.New("vermouth: token is expired")
+	ErrTokenNotYetValid = errors.New("vermouth: token is not valid yet")
+	ErrTokenIssuer      = errors.New("vermouth: token issuer is not accepted")
+	ErrTokenAudience    = errors.New("vermouth: token audience is not accepted")
+	ErrKeyNotFound      = errors.New("vermouth: no key found for token")
+)
+
+// JWTHeader is the decoded JOSE header of a token.
+type JWTHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid,omitempty"`
+	Type      string `json:"typ,omitempty"`
+}
+
+// JWTClaims is the decoded payload of a verified token.
+// Numeric values are kept as json.Number.
+type JWTClaims map[string]interface{}
+
+// String returns the claim name as a string, or an empty string.
+func (c JWTClaims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// Strings returns the claim name as a list of strings.
+// A single string value is returned as a one element list.
+func (c JWTClaims) Strings(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		ss := make([]string, 0, len(v))
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				ss = append(ss, s)
+			}
+		}
+		return ss
+	}
+	return nil
+}
+
+// Time returns the NumericDate claim name as a time.Time.
+func (c JWTClaims) Time(name string) (time.Time, bool) {
+	n, ok := c[name].(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	sec := int64(f)
+	return time.Unix(sec, int64((f-float64(sec))*1e9)), true
+}
+
+// Subject returns the "sub" claim.
+func (c JWTClaims) Subject() string { return c.String("sub") }
+
+// Issuer returns the "iss" claim.
+func (c JWTClaims) Issuer() string { return c.String("iss") }
+
+// Audience returns the "aud" claim.
+func (c JWTClaims) Audience() []string { return c.Strings("aud") }
+
+// Scopes returns the granted scopes, read from the space separated "scope"
+// claim or from the "scp" list.
+func (c JWTClaims) Scopes() []string {
+	if s := c.String("scope"); s != "" {
+		return strings.Fields(s)
+	}
+	return c.Strings("scp")
+}
+
+// HasScope reports whether every given scope has been granted.
+func (c JWTClaims) HasScope(scopes ...string) bool {
+	granted := c.Scopes()
+	for _, want := range scopes {
+		if !containsString(granted, want) {
+			return false
+		}
+	}
+	return true
+}
+
+// Claims returns the verified JWT claims bound to ctx, or nil.
+func Claims(ctx context.Context) JWTClaims {
+	c, _ := ctx.Value(JWTClaimsCtxKey).(JWTClaims)
+	return c
+}
+
+// NewClaimsContext returns a copy of ctx which carries the claims.
+func NewClaimsContext(ctx context.Context, claims JWTClaims) context.Context {
+	return context.WithValue(ctx, JWTClaimsCtxKey, claims)
+}
+
+// KeyResolver returns the verification key for a token.
+// The returned key must be a []byte for HS256, *rsa.PublicKey for RS256,
+// *ecdsa.PublicKey for ES256 or ed25519.PublicKey for EdDSA.
+type KeyResolver interface {
+	ResolveKey(ctx context.Context, header *JWTHeader) (interface{}, error)
+}
+
+// KeyResolverFunc is an adapter to allow the use of ordinary functions as KeyResolver.
+type KeyResolverFunc func(ctx context.Context, header *JWTHeader) (interface{}, error)
+
+// ResolveKey calls f(ctx, header).
+func (f KeyResolverFunc) ResolveKey(ctx context.Context, header *JWTHeader) (interface{}, error) {
+	return f(ctx, header)
+}
+
+// StaticKeys is a KeyResolver backed by a fixed set of keys indexed by key ID.
+// A key registered under the empty ID is used for tokens without "kid".
+type StaticKeys map[string]interface{}
+
+// ResolveKey implements KeyResolver.
+func (ks StaticKeys) ResolveKey(ctx context.Context, header *JWTHeader) (interface{}, error) {
+	if key, ok := ks[header.KeyID]; ok {
+		return key, nil
+	}
+	return nil, ErrKeyNotFound
+}
+
+// JWK is a single JSON Web Key as defined in RFC 7517.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid,omitempty"`
+	Use       string `json:"use,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+	K         string `json:"k,omitempty"`
+}
+
+// Key decodes the public key material of k.
+func (k *JWK) Key() (interface{}, error) {
+	switch k.KeyType {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("vermouth: unsupported curve %q", k.Curve)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Curve != "Ed25519" {
+			return nil, fmt.Errorf("vermouth: unsupported curve %q", k.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("vermouth: invalid Ed25519 key %q", k.KeyID)
+		}
+		return ed25519.PublicKey(x), nil
+	case "oct":
+		return base64.RawURLEncoding.DecodeString(k.K)
+	}
+	return nil, fmt.Errorf("vermouth: unsupported key type %q", k.KeyType)
+}
+
+// ErrNoUsableKeys is returned by ParseJWKS when a JWK Set document has no
+// key which can verify signatures.
+var ErrNoUsableKeys = errors.New("vermouth: JWKS has no usable signature key")
+
+// JWKS is a KeyResolver backed by a JSON Web Key Set document.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+
+	keys map[string]interface{}
+}
+
+// ParseJWKS decodes a JWK Set document. Keys which are not signature keys,
+// e.g. encryption keys, and keys of unsupported types or curves are skipped;
+// ErrNoUsableKeys is returned when no key is left.
+func ParseJWKS(data []byte) (*JWKS, error) {
+	set := &JWKS{}
+	if err := json.Unmarshal(data, set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]interface{}, len(set.Keys))
+	for i := range set.Keys {
+		if set.Keys[i].Use != "" && set.Keys[i].Use != "sig" {
+			continue
+		}
+		key, err := set.Keys[i].Key()
+		if err != nil {
+			continue
+		}
+		keys[set.Keys[i].KeyID] = key
+	}
+	if len(keys) == 0 {
+		return nil, ErrNoUsableKeys
+	}
+	set.keys = keys
+	return set, nil
+}
+
+// LoadJWKSFile reads a JWK Set document from a local file.
+func LoadJWKSFile(filename string) (*JWKS, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseJWKS(data)
+}
+
+// ResolveKey implements KeyResolver.
+func (set *JWKS) ResolveKey(ctx context.Context, header *JWTHeader) (interface{}, error) {
+	if key, ok := set.keys[header.KeyID]; ok {
+		return key, nil
+	}
+	if header.KeyID == "" && len(set.keys) == 1 {
+		for _, key := range set.keys {
+			return key, nil
+		}
+	}
+	return nil, ErrKeyNotFound
+}
+
+// RemoteJWKS is a KeyResolver which fetches a JWK Set document from a URL
+// and caches it. The document is fetched again when the cache is older than
+// RefreshInterval or when a token refers to an unknown key ID, at most once
+// per MinRefreshInterval. Failed fetches count as attempts too, so an outage
+// of the URL does not cost every request a round trip; the cached keys are
+// used meanwhile. Concurrent requests share a single fetch.
+//
+// Zero intervals default to DefaultJWKSRefreshInterval and
+// DefaultJWKSMinRefreshInterval, so that tokens with unknown key IDs cannot
+// force a fetch per request.
+type RemoteJWKS struct {
+	URL    string
+	Client *http.Client
+
+	RefreshInterval    time.Duration
+	MinRefreshInterval time.Duration
+
+	mu        sync.Mutex
+	set       *JWKS
+	err       error
+	fetched   time.Time
+	attempted time.Time
+	inflight  chan struct{}
+}
+
+// Default intervals of RemoteJWKS.
+var (
+	DefaultJWKSRefreshInterval    = time.Hour
+	DefaultJWKSMinRefreshInterval = time.Minute
+)
+
+// NewRemoteJWKS returns a RemoteJWKS for url using http.DefaultClient.
+func NewRemoteJWKS(url string) *RemoteJWKS {
+	return &RemoteJWKS{
+		URL:                url,
+		Client:             http.DefaultClient,
+		RefreshInterval:    DefaultJWKSRefreshInterval,
+		MinRefreshInterval: DefaultJWKSMinRefreshInterval,
+	}
+}
+
+// ResolveKey implements KeyResolver.
+func (r *RemoteJWKS) ResolveKey(ctx context.Context, header *JWTHeader) (interface{}, error) {
+	set, err := r.keys(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	key, err := set.ResolveKey(ctx, header)
+	if err == ErrKeyNotFound {
+		if fresh, ferr := r.keys(ctx, true); ferr == nil && fresh != set {
+			return fresh.ResolveKey(ctx, header)
+		}
+	}
+	return key, err
+}
+
+// keys returns the cached set, fetching it first when it is stale or when
+// refresh is set, unless the last attempt was within MinRefreshInterval.
+func (r *RemoteJWKS) keys(ctx context.Context, refresh bool) (*JWKS, error) {
+	r.mu.Lock()
+	stale := refresh || r.set == nil || time.Since(r.fetched) > orDefault(r.RefreshInterval, DefaultJWKSRefreshInterval)
+	if !stale || time.Since(r.attempted) < orDefault(r.MinRefreshInterval, DefaultJWKSMinRefreshInterval) {
+		defer r.mu.Unlock()
+		return r.result()
+	}
+	if wait := r.inflight; wait != nil {
+		r.mu.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return r.result()
+	}
+	done := make(chan struct{})
+	r.inflight = done
+	previous := r.attempted
+	r.attempted = time.Now()
+	r.mu.Unlock()
+
+	set, err := r.fetch(ctx)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.inflight = nil
+	close(done)
+	switch {
+	case err == nil:
+		r.set, r.err, r.fetched = set, nil, time.Now()
+	case ctx.Err() != nil:
+		// the caller gave up; that says nothing about the URL
+		r.attempted = previous
+	default:
+		r.err = err
+	}
+	if err != nil && r.set == nil {
+		return nil, err
+	}
+	return r.set, nil
+}
+
+// orDefault returns d, or def if d is not positive.
+func orDefault(d, def time.Duration) time.Duration {
+	if d > 0 {
+		return d
+	}
+	return def
+}
+
+// result returns the cached set, or the error of the last fetch if there is
+// none. r.mu must be held.
+func (r *RemoteJWKS) result() (*JWKS, error) {
+	if r.set != nil {
+		return r.set, nil
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return nil, ErrKeyNotFound
+}
+
+func (r *RemoteJWKS) fetch(ctx context.Context) (*JWKS, error) {
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequest("GET", r.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vermouth: fetching JWKS from %s: %s", r.URL, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return ParseJWKS(data)
+}
+
+// JWTAuth is a middleware which verifies a bearer token and binds its claims
+// to the request context.
+type JWTAuth struct {
+	// Keys resolves the verification key of a token.
+	Keys KeyResolver
+
+	// Algorithms lists the accepted "alg" header values.
+	// If empty, DefaultJWTAlgorithms are accepted.
+	Algorithms []string
+
+	// If set, the "iss" claim must equal Issuer.
+	Issuer string
+
+	// If set, the "aud" claim must contain one of Audience.
+	Audience []string
+
+	// Leeway is the allowed clock skew when checking "exp" and "nbf".
+	Leeway time.Duration
+
+	// Optional marks the token as not required. Requests without a token
+	// are passed through without claims; invalid tokens are still rejected.
+	Optional bool
+
+	// Extractor returns the raw token of a request.
+	// By default it is read from the "Authorization: Bearer" header.
+	Extractor func(r *http.Request) string
+
+	// Configurable function which is called when a token is rejected.
+	// If it is not set, a 401 response with a WWW-Authenticate header is written.
+	ErrorHandler func(w http.ResponseWriter, r *http.Request, err error)
+
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+}
+
+// DefaultJWTAlgorithms are the algorithms accepted by a JWTAuth without
+// Algorithms.
+var DefaultJWTAlgorithms = []string{"HS256", "RS256", "ES256", "EdDSA"}
+
+// NewJWTAuth returns a new JWTAuth verifying tokens with keys.
+func NewJWTAuth(keys KeyResolver) *JWTAuth {
+	return &JWTAuth{
+		Keys:       keys,
+		Algorithms: append([]string(nil), DefaultJWTAlgorithms...),
+		Leeway:     time.Minute,
+	}
+}
+
+func (j *JWTAuth) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	var raw string
+	if j.Extractor != nil {
+		raw = j.Extractor(r)
+	} else {
+		raw = BearerToken(r)
+	}
+	if raw == "" {
+		if j.Optional {
+			next(w, r)
+			return
+		}
+		j.reject(w, r, ErrTokenMissing)
+		return
+	}
+	claims, err := j.Verify(r.Context(), raw)
+	if err != nil {
+		j.reject(w, r, err)
+		return
+	}
+	next(w, r.WithContext(NewClaimsContext(r.Context(), claims)))
+}
+
+func (j *JWTAuth) reject(w http.ResponseWriter, r *http.Request, err error) {
+	if j.ErrorHandler != nil {
+		j.ErrorHandler(w, r, err)
+		return
+	}
+	if err == ErrTokenMissing {
+		w.Header().Set("WWW-Authenticate", `Bearer`)
+	} else {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	}
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
+
+// Verify checks the signature and the registered claims of a compact
+// serialized token and returns its claims.
+func (j *JWTAuth) Verify(ctx context.Context, token string) (JWTClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrTokenMalformed
+	}
+	var header JWTHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrTokenMalformed
+	}
+	algorithms := j.Algorithms
+	if len(algorithms) == 0 {
+		algorithms = DefaultJWTAlgorithms
+	}
+	if !containsString(algorithms, header.Algorithm) {
+		return nil, ErrTokenAlgorithm
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrTokenMalformed
+	}
+	key, err := j.Keys.ResolveKey(ctx, &header)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Algorithm, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+	var claims JWTClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrTokenMalformed
+	}
+	if err := j.validate(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (j *JWTAuth) validate(claims JWTClaims) error {
+	now := time.Now()
+	if j.Now != nil {
+		now = j.Now()
+	}
+	if _, ok := claims["exp"]; ok {
+		exp, ok := claims.Time("exp")
+		if !ok {
+			return ErrTokenMalformed
+		}
+		if !now.Before(exp.Add(j.Leeway)) {
+			return ErrTokenExpired
+		}
+	}
+	if _, ok := claims["nbf"]; ok {
+		nbf, ok := claims.Time("nbf")
+		if !ok {
+			return ErrTokenMalformed
+		}
+		if now.Add(j.Leeway).Before(nbf) {
+			return ErrTokenNotYetValid
+		}
+	}
+	if j.Issuer != "" && claims.Issuer() != j.Issuer {
+		return ErrTokenIssuer
+	}
+	if len(j.Audience) > 0 {
+		accepted := false
+		for _, aud := range claims.Audience() {
+			if containsString(j.Audience, aud) {
+				accepted = true
+				break
+			}
+		}
+		if !accepted {
+			return ErrTokenAudience
+		}
+	}
+	return nil
+}
+
+// RequireScope returns a middleware which rejects requests whose token was
+// not granted every given scope with 403 Forbidden.
+// It must be used after a JWTAuth middleware.
+func RequireScope(scopes ...string) HandlerFunc {
+	return RequireClaims(func(claims JWTClaims) bool {
+		return claims.HasScope(scopes...)
+	})
+}
+
+// RequireClaim returns a middleware which rejects requests whose token claim
+// name does not contain one of values with 403 Forbidden.
+// It must be used after a JWTAuth middleware.
+func RequireClaim(name string, values ...string) HandlerFunc {
+	return RequireClaims(func(claims JWTClaims) bool {
+		for _, v := range claims.Strings(name) {
+			if containsString(values, v) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// RequireClaims returns a middleware which rejects requests with 403 Forbidden
+// unless allow returns true for the token claims. Requests without claims are
+// rejected with 401 Unauthorized.
+func RequireClaims(allow func(JWTClaims) bool) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		claims := Claims(r.Context())
+		if claims == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		if !allow(claims) {
+			w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope"`)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// BearerToken returns the token of an "Authorization: Bearer" request header.
+func BearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+func verifySignature(alg string, key interface{}, signed, sig []byte) error {
+	switch alg {
+	case "HS256":
+		secret, ok := key.([]byte)
+		if !ok {
+			return ErrTokenAlgorithm
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		if subtle.ConstantTimeCompare(mac.Sum(nil), sig) != 1 {
+			return ErrTokenSignature
+		}
+		return nil
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return ErrTokenAlgorithm
+		}
+		sum := sha256.Sum256(signed)
+		if rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig) != nil {
+			return ErrTokenSignature
+		}
+		return nil
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || pub.Curve != elliptic.P256() {
+			return ErrTokenAlgorithm
+		}
+		if len(sig) != 64 {
+			return ErrTokenSignature
+		}
+		sum := sha256.Sum256(signed)
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(pub, sum[:], r, s) {
+			return ErrTokenSignature
+		}
+		return nil
+	case "EdDSA":
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return ErrTokenAlgorithm
+		}
+		if !ed25519.Verify(pub, signed, sig) {
+			return ErrTokenSignature
+		}
+		return nil
+	}
+	return ErrTokenAlgorithm
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
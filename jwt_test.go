@@ -0,0 +1,289 @@
+package vermouth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func signToken(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	header, _ := json.Marshal(JWTHeader{Algorithm: alg, KeyID: kid, Type: "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		sig, _ = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum[:])
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, sum[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(signed))
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTAuthAlgorithms(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	edPub, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	secret := []byte("secret")
+
+	auth := NewJWTAuth(StaticKeys{
+		"hs": secret,
+		"rs": &rsaKey.PublicKey,
+		"es": &ecKey.PublicKey,
+		"ed": edPub,
+	})
+	claims := map[string]interface{}{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()}
+
+	for _, tc := range []struct {
+		alg, kid string
+		key      interface{}
+	}{
+		{"HS256", "hs", secret},
+		{"RS256", "rs", rsaKey},
+		{"ES256", "es", ecKey},
+		{"EdDSA", "ed", edKey},
+	} {
+		got, err := auth.Verify(context.Background(), signToken(t, tc.alg, tc.kid, tc.key, claims))
+		if err != nil {
+			t.Errorf("%s: %v", tc.alg, err)
+			continue
+		}
+		expect(t, got.Subject(), "alice")
+	}
+
+	// key confusion: an HMAC token must not verify against an RSA key
+	_, err := auth.Verify(context.Background(), signToken(t, "HS256", "rs", secret, claims))
+	expect(t, err, ErrTokenAlgorithm)
+
+	_, err = auth.Verify(context.Background(), signToken(t, "HS256", "hs", []byte("other"), claims))
+	expect(t, err, ErrTokenSignature)
+}
+
+func TestJWTAuthRegisteredClaims(t *testing.T) {
+	secret := []byte("secret")
+	now := time.Unix(1000000, 0)
+	auth := NewJWTAuth(StaticKeys{"": secret})
+	auth.Issuer = "https://idp.example.com"
+	auth.Audience = []string{"api"}
+	auth.Leeway = 30 * time.Second
+	auth.Now = func() time.Time { return now }
+
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss": "https://idp.example.com",
+			"aud": []string{"web", "api"},
+			"exp": now.Unix() + 60,
+			"nbf": now.Unix() - 60,
+		}
+	}
+	for _, tc := range []struct {
+		name   string
+		modify func(map[string]interface{})
+		err    error
+	}{
+		{"valid", func(map[string]interface{}) {}, nil},
+		{"expired within leeway", func(c map[string]interface{}) { c["exp"] = now.Unix() - 10 }, nil},
+		{"expired", func(c map[string]interface{}) { c["exp"] = now.Unix() - 31 }, ErrTokenExpired},
+		{"not yet valid within leeway", func(c map[string]interface{}) { c["nbf"] = now.Unix() + 10 }, nil},
+		{"not yet valid", func(c map[string]interface{}) { c["nbf"] = now.Unix() + 31 }, ErrTokenNotYetValid},
+		{"issuer", func(c map[string]interface{}) { c["iss"] = "evil" }, ErrTokenIssuer},
+		{"audience", func(c map[string]interface{}) { c["aud"] = "web" }, ErrTokenAudience},
+	} {
+		claims := valid()
+		tc.modify(claims)
+		_, err := auth.Verify(context.Background(), signToken(t, "HS256", "", secret, claims))
+		if err != tc.err {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.err, err)
+		}
+	}
+}
+
+func TestJWTAuthMiddleware(t *testing.T) {
+	secret := []byte("secret")
+	vm := New()
+	vm.Use("/", NewJWTAuth(StaticKeys{"": secret}))
+	vm.Use("/admin", RequireScope("admin"))
+	vm.Get("/me", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, Claims(r.Context()).Subject())
+	})
+	vm.Get("/admin/users", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "users")
+	})
+
+	request := func(path, token string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		vm.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := request("/me", "")
+	expect(t, rec.Code, http.StatusUnauthorized)
+	expect(t, rec.Header().Get("WWW-Authenticate"), "Bearer")
+
+	user := signToken(t, "HS256", "", secret, map[string]interface{}{"sub": "bob", "scope": "read"})
+	rec = request("/me", user)
+	expect(t, rec.Code, http.StatusOK)
+	expect(t, rec.Body.String(), "bob")
+
+	rec = request("/admin/users", user)
+	expect(t, rec.Code, http.StatusForbidden)
+
+	admin := signToken(t, "HS256", "", secret, map[string]interface{}{"sub": "root", "scope": "read admin"})
+	rec = request("/admin/users", admin)
+	expect(t, rec.Code, http.StatusOK)
+}
+
+func TestRemoteJWKS(t *testing.T) {
+	edPub, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	doc, _ := json.Marshal(map[string]interface{}{
+		"keys": []JWK{{KeyType: "OKP", Curve: "Ed25519", KeyID: "k1", X: base64.RawURLEncoding.EncodeToString(edPub)}},
+	})
+	fetches := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Write(doc)
+	}))
+	defer srv.Close()
+
+	auth := NewJWTAuth(NewRemoteJWKS(srv.URL))
+	token := signToken(t, "EdDSA", "k1", edKey, map[string]interface{}{"sub": "carol"})
+	for i := 0; i < 2; i++ {
+		claims, err := auth.Verify(context.Background(), token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect(t, claims.Subject(), "carol")
+	}
+	expect(t, fetches, 1)
+}
+
+func TestRemoteJWKSBacksOffAfterFailure(t *testing.T) {
+	edPub, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	doc, _ := json.Marshal(map[string]interface{}{
+		"keys": []JWK{{KeyType: "OKP", Curve: "Ed25519", KeyID: "k1", X: base64.RawURLEncoding.EncodeToString(edPub)}},
+	})
+	var mu sync.Mutex
+	fetches, down := 0, true
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetches++
+		failing := down
+		mu.Unlock()
+		<-release
+		if failing {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(doc)
+	}))
+	defer srv.Close()
+
+	keys := NewRemoteJWKS(srv.URL)
+	auth := &JWTAuth{Keys: keys}
+	token := signToken(t, "EdDSA", "k1", edKey, map[string]interface{}{"sub": "carol"})
+
+	// concurrent requests share one fetch, and its failure is remembered
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := auth.Verify(context.Background(), token)
+			refute(t, err, nil)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	_, err := auth.Verify(context.Background(), token)
+	refute(t, err, nil)
+	expect(t, fetches, 1)
+
+	// the next attempt happens after MinRefreshInterval
+	mu.Lock()
+	down = false
+	mu.Unlock()
+	keys.MinRefreshInterval = 10 * time.Millisecond
+	time.Sleep(20 * time.Millisecond)
+	claims, err := auth.Verify(context.Background(), token)
+	expect(t, err, nil)
+	expect(t, claims.Subject(), "carol")
+	expect(t, fetches, 2)
+}
+
+func TestParseJWKSSkipsUnusableKeys(t *testing.T) {
+	edPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	doc, _ := json.Marshal(map[string]interface{}{
+		"keys": []JWK{
+			{KeyType: "RSA", KeyID: "enc", Use: "enc", N: "AQAB", E: "AQAB"},
+			{KeyType: "EC", KeyID: "k256", Curve: "secp256k1", X: "AQAB", Y: "AQAB"},
+			{KeyType: "OKP", KeyID: "x25519", Curve: "X25519", X: "AQAB"},
+			{KeyType: "OKP", Curve: "Ed25519", KeyID: "k1", X: base64.RawURLEncoding.EncodeToString(edPub)},
+		},
+	})
+	set, err := ParseJWKS(doc)
+	expect(t, err, nil)
+	key, err := set.ResolveKey(context.Background(), &JWTHeader{KeyID: "k1"})
+	expect(t, err, nil)
+	expect(t, string(key.(ed25519.PublicKey)), string(edPub))
+	_, err = set.ResolveKey(context.Background(), &JWTHeader{KeyID: "enc"})
+	expect(t, err, ErrKeyNotFound)
+
+	_, err = ParseJWKS([]byte(`{"keys":[{"kty":"OKP","crv":"X25519","x":"AQAB"}]}`))
+	expect(t, err, ErrNoUsableKeys)
+}
+
+func TestRemoteJWKSZeroValueLimitsFetches(t *testing.T) {
+	edPub, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	doc, _ := json.Marshal(map[string]interface{}{
+		"keys": []JWK{{KeyType: "OKP", Curve: "Ed25519", KeyID: "k1", X: base64.RawURLEncoding.EncodeToString(edPub)}},
+	})
+	var fetches int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Write(doc)
+	}))
+	defer srv.Close()
+
+	auth := &JWTAuth{Keys: &RemoteJWKS{URL: srv.URL}}
+	for i := 0; i < 5; i++ {
+		token := signToken(t, "EdDSA", fmt.Sprintf("unknown%d", i), edKey, map[string]interface{}{"sub": "carol"})
+		_, err := auth.Verify(context.Background(), token)
+		expect(t, err, ErrKeyNotFound)
+	}
+	expect(t, atomic.LoadInt32(&fetches), int32(1))
+}
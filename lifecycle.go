@@ -0,0 +1,78 @@
+package vermouth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+type lifecycleHooks struct {
+	start    []func(context.Context) error
+	shutdown []func(context.Context) error
+	stopped  []func()
+}
+
+// OnStart registers a function which is called before the server accepts
+// connections. Start hooks run in registration order; if one returns an
+// error, the remaining hooks are skipped and the server is not started.
+// The context is derived from the vermouth context and bound by
+// Options.StartTimeout.
+func (vm *Vermouth) OnStart(fn func(ctx context.Context) error) *Vermouth {
+	vm.hooks.start = append(vm.hooks.start, fn)
+	return vm
+}
+
+// OnShutdown registers a function which is called after the server has
+// stopped accepting connections and outstanding requests have drained.
+// Shutdown hooks run in reverse registration order and share the deadline of
+// Options.GracefulTimeout with draining. Every hook runs even if a former one
+// fails.
+func (vm *Vermouth) OnShutdown(fn func(ctx context.Context) error) *Vermouth {
+	vm.hooks.shutdown = append(vm.hooks.shutdown, fn)
+	return vm
+}
+
+// OnStopped registers a function which is called last, after every shutdown
+// hook, in registration order.
+func (vm *Vermouth) OnStopped(fn func()) *Vermouth {
+	vm.hooks.stopped = append(vm.hooks.stopped, fn)
+	return vm
+}
+
+func (vm *Vermouth) runStartHooks() error {
+	ctx, cancel := context.WithCancel(vm.ctx)
+	if vm.Options != nil && vm.Options.StartTimeout > 0 {
+		cancel()
+		ctx, cancel = context.WithTimeout(vm.ctx, vm.Options.StartTimeout)
+	}
+	defer cancel()
+
+	for i, fn := range vm.hooks.start {
+		if err := fn(ctx); err != nil {
+			return fmt.Errorf("vermouth: start hook %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// runStopHooks runs the shutdown and stopped hooks, and returns err joined
+// with the errors of the hooks.
+func (vm *Vermouth) runStopHooks(srv *Server, err error) error {
+	errs := []error{err}
+	if len(vm.hooks.shutdown) > 0 {
+		ctx, cancel := srv.shutdownContext()
+		for i := len(vm.hooks.shutdown) - 1; i >= 0; i-- {
+			if herr := vm.hooks.shutdown[i](ctx); herr != nil {
+				errs = append(errs, fmt.Errorf("vermouth: shutdown hook %d: %w", i, herr))
+			}
+		}
+		cancel()
+	}
+	for _, fn := range vm.hooks.stopped {
+		fn()
+	}
+	if len(errs) == 1 {
+		return err
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,79 @@
+package vermouth
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLifecycleHooks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	vm := New().WithContext(ctx)
+	vm.Options.GracefulTimeout = time.Second
+
+	var calls []string
+	var deadlines []time.Time
+	vm.OnStart(func(ctx context.Context) error {
+		calls = append(calls, "start1")
+		return nil
+	})
+	vm.OnStart(func(ctx context.Context) error {
+		calls = append(calls, "start2")
+		cancel()
+		return nil
+	})
+	for _, name := range []string{"shutdown1", "shutdown2"} {
+		name := name
+		vm.OnShutdown(func(ctx context.Context) error {
+			calls = append(calls, name)
+			d, _ := ctx.Deadline()
+			deadlines = append(deadlines, d)
+			if name == "shutdown2" {
+				return errors.New("flush failed")
+			}
+			return nil
+		})
+	}
+	vm.OnStopped(func() { calls = append(calls, "stopped") })
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = vm.ServeListener(l)
+	expect(t, strings.Join(calls, ","), "start1,start2,shutdown2,shutdown1,stopped")
+	if err == nil || !strings.Contains(err.Error(), "flush failed") {
+		t.Errorf("expected shutdown hook error, got %v", err)
+	}
+	expect(t, len(deadlines), 2)
+	expect(t, deadlines[0].IsZero(), false)
+	expect(t, deadlines[0], deadlines[1])
+}
+
+func TestLifecycleStartHookVeto(t *testing.T) {
+	vm := New()
+	veto := errors.New("cache warmup failed")
+	vm.OnStart(func(ctx context.Context) error { return veto })
+	vm.OnStart(func(ctx context.Context) error {
+		t.Error("hook after a failed start hook was called")
+		return nil
+	})
+	vm.OnShutdown(func(ctx context.Context) error {
+		t.Error("shutdown hook was called after a vetoed start")
+		return nil
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = vm.ServeListener(l)
+	expect(t, errors.Is(err, veto), true)
+
+	// the listener is closed
+	_, err = net.Dial("tcp", l.Addr().String())
+	refute(t, err, nil)
+}
@@ -0,0 +1,215 @@
+package vermouth
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Listen announces on the address addr, which is one of
+//
+//	host:port                  TCP address, as for net.Listen("tcp", addr)
+//	tcp://host:port            likewise; tcp4:// and tcp6:// are accepted too
+//	unix:///run/app.sock       Unix domain socket at the given path
+//	unix://@name               abstract Unix domain socket (Linux only)
+//	systemd://name             socket passed by systemd, see SystemdListener
+//
+// A socket file left behind by a process which is no longer listening is
+// removed before listening. The socket file is removed when the listener is
+// closed.
+//
+// In a process started by Upgrade, the listener passed on by the former
+// process for addr is returned.
+func Listen(addr string) (net.Listener, error) {
+	if l := inheritedListener(addr); l != nil {
+		return l, nil
+	}
+	network, address := parseAddr(addr)
+	switch network {
+	case "systemd":
+		return SystemdListener(address)
+	case "unix":
+	default:
+		return net.Listen(network, address)
+	}
+	if strings.HasPrefix(address, "@") {
+		if runtime.GOOS != "linux" {
+			return nil, fmt.Errorf("vermouth: abstract unix sockets are not supported on %s", runtime.GOOS)
+		}
+		return net.Listen("unix", address)
+	}
+	if err := removeStaleSocket(address); err != nil {
+		return nil, err
+	}
+	return net.Listen("unix", address)
+}
+
+// listen is like Listen, but applies the Unix socket options of vm.
+func (vm *Vermouth) listen(addr string) (net.Listener, error) {
+	network, path := parseAddr(addr)
+	if network != "unix" || strings.HasPrefix(path, "@") || vm.Options == nil ||
+		(vm.Options.UnixSocketMode == 0 && vm.Options.UnixSocketOwner == "") {
+		return Listen(addr)
+	}
+	if l := inheritedListener(addr); l != nil {
+		return l, nil
+	}
+	return listenUnixPrivate(path, vm.Options.UnixSocketMode, vm.Options.UnixSocketOwner)
+}
+
+// listenUnixPrivate creates the socket in a private directory next to path,
+// applies mode and owner, and only then moves it to path, so that it is
+// never reachable with the permissions left by the umask.
+func listenUnixPrivate(path string, mode os.FileMode, owner string) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".vermouth")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	l.SetUnlinkOnClose(false)
+	err = chownSocket(tmp, mode, owner)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return &unixListener{UnixListener: l, path: path, unlink: true}, nil
+}
+
+// unixListener is a Unix socket listener whose socket file was moved to path.
+type unixListener struct {
+	*net.UnixListener
+	path string
+
+	mu     sync.Mutex
+	unlink bool
+}
+
+// Addr returns the address of the socket file.
+func (l *unixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+// SetUnlinkOnClose sets whether the socket file is removed when the listener
+// is closed, as net.UnixListener.SetUnlinkOnClose does.
+func (l *unixListener) SetUnlinkOnClose(unlink bool) {
+	l.mu.Lock()
+	l.unlink = unlink
+	l.mu.Unlock()
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	l.mu.Lock()
+	unlink := l.unlink
+	l.unlink = false
+	l.mu.Unlock()
+	if unlink {
+		os.Remove(l.path)
+	}
+	return err
+}
+
+func parseAddr(addr string) (network, address string) {
+	if i := strings.Index(addr, "://"); i >= 0 {
+		return addr[:i], addr[i+3:]
+	}
+	if strings.HasPrefix(addr, "unix:") {
+		return "unix", addr[5:]
+	}
+	if addr == "" {
+		addr = ":http"
+	}
+	return "tcp", addr
+}
+
+// removeStaleSocket removes the socket file at path unless a process is
+// still accepting connections on it.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("vermouth: %s exists and is not a socket", path)
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("vermouth: %s is in use by another process", path)
+	}
+	return os.Remove(path)
+}
+
+func chownSocket(path string, mode os.FileMode, owner string) error {
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+	}
+	if owner == "" {
+		return nil
+	}
+	uid, gid, err := lookupOwner(owner)
+	if err != nil {
+		return err
+	}
+	return os.Lchown(path, uid, gid)
+}
+
+// lookupOwner resolves "user", "user:group" or ":group" to numeric IDs.
+// Missing parts are returned as -1, which leaves them unchanged.
+func lookupOwner(owner string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	name, group := owner, ""
+	if i := strings.IndexByte(owner, ':'); i >= 0 {
+		name, group = owner[:i], owner[i+1:]
+	}
+	if name != "" {
+		if uid, err = strconv.Atoi(name); err != nil {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return -1, -1, err
+			}
+			if uid, err = strconv.Atoi(u.Uid); err != nil {
+				return -1, -1, errors.New("vermouth: non-numeric uid " + u.Uid)
+			}
+			if group == "" {
+				group = u.Gid
+			}
+		}
+	}
+	if group != "" {
+		if gid, err = strconv.Atoi(group); err != nil {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return -1, -1, err
+			}
+			if gid, err = strconv.Atoi(g.Gid); err != nil {
+				return -1, -1, errors.New("vermouth: non-numeric gid " + g.Gid)
+			}
+		}
+	}
+	return uid, gid, nil
+}
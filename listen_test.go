@@ -0,0 +1,143 @@
+package vermouth
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func unixClient(network, address string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, address)
+		},
+	}}
+}
+
+func TestServeUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vermouth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.sock")
+
+	// leave a stale socket file behind
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	vm := New().WithContext(ctx)
+	vm.Options.UnixSocketMode = 0660
+	vm.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("unix"))
+	})
+	errc := make(chan error, 1)
+	go func() { errc <- vm.Serve("unix://" + path) }()
+
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		if resp, err = unixClient("unix", path).Get("http://unix/"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	expect(t, string(body), "unix")
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, fi.Mode().Perm(), os.FileMode(0660))
+
+	// a socket in use is not removed
+	_, err = Listen("unix://" + path)
+	refute(t, err, nil)
+
+	cancel()
+	expect(t, <-errc, nil)
+	_, err = os.Stat(path)
+	expect(t, os.IsNotExist(err), true)
+}
+
+func TestListenAbstractSocket(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract sockets are Linux only")
+	}
+	name := "@vermouth-test-" + time.Now().Format("150405.000000000")
+	l, err := Listen("unix://" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("abstract"))
+	}))
+	resp, err := unixClient("unix", name).Get("http://unix/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	expect(t, string(body), "abstract")
+}
+
+func TestListenRejectsNonSocketFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "vermouth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	_, err = Listen("unix://" + f.Name())
+	refute(t, err, nil)
+}
+
+func TestListenUnixSocketModeIsSetBeforeListening(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vermouth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.sock")
+
+	vm := New()
+	vm.Options.UnixSocketMode = 0600
+	l, err := vm.listen("unix://" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, l.Addr().String(), path)
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, fi.Mode().Perm(), os.FileMode(0600))
+	// the private directory the socket was created in is gone
+	entries, _ := ioutil.ReadDir(dir)
+	expect(t, len(entries), 1)
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	l.Close()
+	_, err = os.Stat(path)
+	expect(t, os.IsNotExist(err), true)
+}
@@ -0,0 +1,365 @@
+package vermouth
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidProxyHeader is returned when a connection starts with a malformed PROXY protocol header.
+var ErrInvalidProxyHeader = errors.New("vermouth: invalid PROXY protocol header")
+
+// Types of PROXY protocol v2 TLVs.
+const (
+	ProxyTLVALPN      = 0x01
+	ProxyTLVAuthority = 0x02
+	ProxyTLVCRC32C    = 0x03
+	ProxyTLVNoop      = 0x04
+	ProxyTLVUniqueID  = 0x05
+	ProxyTLVSSL       = 0x20
+	ProxyTLVNetNS     = 0x30
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyTLV is a type-length-value field of a PROXY protocol v2 header.
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// ProxyHeader is a parsed PROXY protocol header.
+type ProxyHeader struct {
+	Version int
+
+	// Local is set for v2 LOCAL commands, e.g. health checks of the proxy,
+	// and for v1 UNKNOWN connections. The connection addresses are kept.
+	Local bool
+
+	Source      net.Addr
+	Destination net.Addr
+	TLVs        []ProxyTLV
+}
+
+// TLV returns the value of the first TLV of type typ.
+func (h *ProxyHeader) TLV(typ byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == typ {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// ProxyListener accepts connections preceded by a HAProxy PROXY protocol v1
+// or v2 header, and reports the addresses of the header as RemoteAddr and
+// LocalAddr of the connection.
+//
+// Headers are only read from trusted sources; connections from other sources
+// are passed through unchanged. A trusted connection without a header is also
+// accepted as is. Headers are read in the background, so slow clients do not
+// hold up Accept.
+type ProxyListener struct {
+	net.Listener
+
+	// Trusted lists the networks of the proxies. If empty, no source is
+	// trusted and every connection is passed through unchanged.
+	Trusted []*net.IPNet
+
+	// Timeout limits the time to read the header. If zero, it is 10 seconds.
+	Timeout time.Duration
+
+	once      sync.Once
+	closeOnce sync.Once
+	conns     chan net.Conn
+	errc      chan error
+	done      chan struct{}
+}
+
+// NewProxyListener returns a ProxyListener trusting the networks in CIDR notation.
+// A plain IP address is trusted as a single host.
+func NewProxyListener(l net.Listener, trusted []string) (*ProxyListener, error) {
+	nets, err := parseCIDRs(trusted)
+	if err != nil {
+		return nil, err
+	}
+	return &ProxyListener{Listener: l, Trusted: nets}, nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, s := range cidrs {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("vermouth: invalid IP address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("vermouth: %v", err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Accept returns the next connection whose header has been read.
+func (l *ProxyListener) Accept() (net.Conn, error) {
+	l.once.Do(l.start)
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case err := <-l.errc:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the listener.
+func (l *ProxyListener) Close() error {
+	l.once.Do(l.start)
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+func (l *ProxyListener) start() {
+	l.conns = make(chan net.Conn)
+	l.errc = make(chan error)
+	l.done = make(chan struct{})
+	go l.acceptLoop()
+}
+
+func (l *ProxyListener) acceptLoop() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				l.closeOnce.Do(func() { close(l.done) })
+				return
+			}
+			// hand over errors like EMFILE, after which the caller may
+			// retry Accept, as http.Server does
+			select {
+			case l.errc <- err:
+			case <-l.done:
+				return
+			}
+			continue
+		}
+		go l.handshake(c)
+	}
+}
+
+func (l *ProxyListener) handshake(c net.Conn) {
+	pc := &ProxyConn{Conn: c, r: bufio.NewReader(c)}
+	if l.trusted(c.RemoteAddr()) {
+		timeout := l.Timeout
+		if timeout <= 0 {
+			timeout = 10 * time.Second
+		}
+		c.SetReadDeadline(time.Now().Add(timeout))
+		h, err := readProxyHeader(pc.r)
+		c.SetReadDeadline(time.Time{})
+		if err != nil {
+			c.Close()
+			return
+		}
+		pc.header = h
+	}
+	select {
+	case l.conns <- pc:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+func (l *ProxyListener) trusted(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	return ok && containsIP(l.Trusted, tcp.IP)
+}
+
+// ProxyConn is a connection accepted by ProxyListener.
+type ProxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	header *ProxyHeader
+}
+
+// Header returns the PROXY protocol header of the connection, or nil.
+func (c *ProxyConn) Header() *ProxyHeader {
+	return c.header
+}
+
+func (c *ProxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the source address of the header.
+func (c *ProxyConn) RemoteAddr() net.Addr {
+	if c.header != nil && !c.header.Local && c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address of the header.
+func (c *ProxyConn) LocalAddr() net.Addr {
+	if c.header != nil && !c.header.Local && c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// readProxyHeader reads a v1 or v2 header from r. It returns nil without an
+// error when the stream does not start with a header.
+func readProxyHeader(r *bufio.Reader) (*ProxyHeader, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch b[0] {
+	case 'P':
+		if b, _ := r.Peek(6); bytes.Equal(b, []byte("PROXY ")) {
+			return readProxyV1(r)
+		}
+	case '\r':
+		if b, _ := r.Peek(len(proxyV2Signature)); bytes.Equal(b, proxyV2Signature) {
+			return readProxyV2(r)
+		}
+	}
+	return nil, nil
+}
+
+func readProxyV1(r *bufio.Reader) (*ProxyHeader, error) {
+	// the longest v1 header is 107 bytes including CRLF
+	var line []byte
+	for len(line) < 107 {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrInvalidProxyHeader
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	h := &ProxyHeader{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		h.Local = true
+		return h, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrInvalidProxyHeader
+	}
+	src, dst := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	sport, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dport, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if src == nil || dst == nil || err1 != nil || err2 != nil {
+		return nil, ErrInvalidProxyHeader
+	}
+	h.Source = &net.TCPAddr{IP: src, Port: int(sport)}
+	h.Destination = &net.TCPAddr{IP: dst, Port: int(dport)}
+	return h, nil
+}
+
+func readProxyV2(r *bufio.Reader) (*ProxyHeader, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, ErrInvalidProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	h := &ProxyHeader{Version: 2}
+	switch hdr[12] & 0xf {
+	case 0x0:
+		h.Local = true
+	case 0x1:
+	default:
+		return nil, ErrInvalidProxyHeader
+	}
+
+	var addrLen int
+	family, proto := hdr[13]>>4, hdr[13]&0xf
+	switch family {
+	case 0x1:
+		addrLen = 12
+	case 0x2:
+		addrLen = 36
+	case 0x3:
+		addrLen = 216
+	case 0x0:
+		h.Local = true
+	default:
+		return nil, ErrInvalidProxyHeader
+	}
+	if len(body) < addrLen {
+		return nil, ErrInvalidProxyHeader
+	}
+	addrs := body[:addrLen]
+	switch family {
+	case 0x1, 0x2:
+		n := addrLen/2 - 2
+		src, dst := net.IP(addrs[:n]), net.IP(addrs[n:2*n])
+		sport := int(binary.BigEndian.Uint16(addrs[2*n:]))
+		dport := int(binary.BigEndian.Uint16(addrs[2*n+2:]))
+		if proto == 0x2 {
+			h.Source = &net.UDPAddr{IP: src, Port: sport}
+			h.Destination = &net.UDPAddr{IP: dst, Port: dport}
+		} else {
+			h.Source = &net.TCPAddr{IP: src, Port: sport}
+			h.Destination = &net.TCPAddr{IP: dst, Port: dport}
+		}
+	case 0x3:
+		h.Source = &net.UnixAddr{Name: string(bytes.TrimRight(addrs[:108], "\x00")), Net: "unix"}
+		h.Destination = &net.UnixAddr{Name: string(bytes.TrimRight(addrs[108:], "\x00")), Net: "unix"}
+	}
+
+	tlvs := body[addrLen:]
+	for len(tlvs) > 0 {
+		if len(tlvs) < 3 {
+			return nil, ErrInvalidProxyHeader
+		}
+		n := int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+n {
+			return nil, ErrInvalidProxyHeader
+		}
+		h.TLVs = append(h.TLVs, ProxyTLV{Type: tlvs[0], Value: tlvs[3 : 3+n]})
+		tlvs = tlvs[3+n:]
+	}
+	return h, nil
+}
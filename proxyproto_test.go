@@ -0,0 +1,271 @@
+package vermouth
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func proxyV2Header(cmd, family byte, addrs []byte, tlvs ...ProxyTLV) []byte {
+	var body bytes.Buffer
+	body.Write(addrs)
+	for _, tlv := range tlvs {
+		body.WriteByte(tlv.Type)
+		binary.Write(&body, binary.BigEndian, uint16(len(tlv.Value)))
+		body.Write(tlv.Value)
+	}
+	var b bytes.Buffer
+	b.Write(proxyV2Signature)
+	b.WriteByte(0x20 | cmd)
+	b.WriteByte(family)
+	binary.Write(&b, binary.BigEndian, uint16(body.Len()))
+	b.Write(body.Bytes())
+	return b.Bytes()
+}
+
+func TestReadProxyHeaderV1(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET / HTTP/1.1\r\n"))
+	h, err := readProxyHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, h.Version, 1)
+	expect(t, h.Source.String(), "192.0.2.1:56324")
+	expect(t, h.Destination.String(), "198.51.100.1:443")
+	rest, _ := ioutil.ReadAll(r)
+	expect(t, string(rest), "GET / HTTP/1.1\r\n")
+
+	h, err = readProxyHeader(bufio.NewReader(strings.NewReader("PROXY UNKNOWN\r\n")))
+	expect(t, err, nil)
+	expect(t, h.Local, true)
+
+	for _, s := range []string{
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n",
+		"PROXY TCP4 192.0.2.1 example 56324 443\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n",
+		"PROXY " + strings.Repeat("x", 120),
+	} {
+		_, err := readProxyHeader(bufio.NewReader(strings.NewReader(s)))
+		refute(t, err, nil)
+	}
+}
+
+func TestReadProxyHeaderV2(t *testing.T) {
+	addrs := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}
+	b := proxyV2Header(0x1, 0x11, addrs,
+		ProxyTLV{Type: ProxyTLVAuthority, Value: []byte("example.com")},
+		ProxyTLV{Type: ProxyTLVUniqueID, Value: []byte{1, 2, 3}},
+	)
+	r := bufio.NewReader(bytes.NewReader(append(b, "GET"...)))
+	h, err := readProxyHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, h.Version, 2)
+	expect(t, h.Local, false)
+	expect(t, h.Source.String(), "192.0.2.1:56324")
+	expect(t, h.Destination.String(), "198.51.100.1:443")
+	authority, ok := h.TLV(ProxyTLVAuthority)
+	expect(t, ok, true)
+	expect(t, string(authority), "example.com")
+	_, ok = h.TLV(ProxyTLVSSL)
+	expect(t, ok, false)
+	rest, _ := ioutil.ReadAll(r)
+	expect(t, string(rest), "GET")
+
+	addrs6 := make([]byte, 36)
+	copy(addrs6, net.ParseIP("2001:db8::1"))
+	copy(addrs6[16:], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(addrs6[32:], 1234)
+	binary.BigEndian.PutUint16(addrs6[34:], 80)
+	h, err = readProxyHeader(bufio.NewReader(bytes.NewReader(proxyV2Header(0x1, 0x21, addrs6))))
+	expect(t, err, nil)
+	expect(t, h.Source.String(), "[2001:db8::1]:1234")
+
+	h, err = readProxyHeader(bufio.NewReader(bytes.NewReader(proxyV2Header(0x0, 0x00, nil))))
+	expect(t, err, nil)
+	expect(t, h.Local, true)
+
+	// truncated TLV
+	bad := proxyV2Header(0x1, 0x11, append(addrs, ProxyTLVNoop, 0, 5, 1))
+	_, err = readProxyHeader(bufio.NewReader(bytes.NewReader(bad)))
+	expect(t, err, ErrInvalidProxyHeader)
+}
+
+func TestReadProxyHeaderWithoutHeader(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("POST / HTTP/1.1\r\n"))
+	h, err := readProxyHeader(r)
+	expect(t, err, nil)
+	expect(t, h == nil, true)
+	rest, _ := ioutil.ReadAll(r)
+	expect(t, string(rest), "POST / HTTP/1.1\r\n")
+}
+
+func proxyRemoteAddr(t *testing.T, configure func(*Options), header string) string {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	url, _ := serveTestApp(t, ctx, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.RemoteAddr))
+	}, configure)
+
+	conn, err := net.Dial("tcp", strings.TrimSuffix(strings.TrimPrefix(url, "http://"), "/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(header + "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return string(body)
+}
+
+func TestServeProxyProtocol(t *testing.T) {
+	header := "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+	expect(t, proxyRemoteAddr(t, func(o *Options) {
+		o.ProxyProtocol = true
+		o.ProxyProtocolTrusted = []string{"127.0.0.0/8"}
+	}, header), "192.0.2.1:56324")
+
+	// headers of untrusted sources are not interpreted
+	body := proxyRemoteAddr(t, func(o *Options) {
+		o.ProxyProtocol = true
+		o.ProxyProtocolTrusted = []string{"10.0.0.1"}
+	}, header)
+	expect(t, strings.HasPrefix(body, "400"), true)
+
+	// a trusted connection without a header is used as is
+	addr := proxyRemoteAddr(t, func(o *Options) {
+		o.ProxyProtocol = true
+		o.ProxyProtocolTrusted = []string{"127.0.0.1"}
+	}, "")
+	expect(t, strings.HasPrefix(addr, "127.0.0.1:"), true)
+}
+
+func TestServeProxyProtocolRequiresTrusted(t *testing.T) {
+	_, errc := serveTestApp(t, context.Background(), func(w http.ResponseWriter, r *http.Request) {}, func(o *Options) {
+		o.ProxyProtocol = true
+	})
+	select {
+	case err := <-errc:
+		refute(t, err, nil)
+	case <-time.After(5 * time.Second):
+		t.Fatal("serving without trusted proxies did not fail")
+	}
+}
+
+func TestProxyListenerTrustsNoneByDefault(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &ProxyListener{Listener: raw}
+	defer l.Close()
+
+	c, err := net.Dial("tcp", raw.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("PROXY TCP4 192.0.2.7 198.51.100.1 1000 80\r\n"))
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+	expect(t, accepted.RemoteAddr().String(), c.LocalAddr().String())
+	expect(t, accepted.(*ProxyConn).Header() == nil, true)
+}
+
+// flakyListener fails its first Accept with a temporary error.
+type flakyListener struct {
+	net.Listener
+	failed bool
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if !l.failed {
+		l.failed = true
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}
+	}
+	return l.Listener.Accept()
+}
+
+func TestProxyListenerKeepsAcceptingAfterErrors(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &ProxyListener{Listener: &flakyListener{Listener: raw}}
+
+	_, err = l.Accept()
+	refute(t, err, nil)
+	c, err := net.Dial("tcp", raw.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted.Close()
+
+	l.Close()
+	_, err = l.Accept()
+	expect(t, errors.Is(err, net.ErrClosed), true)
+}
+
+func TestProxyListenerSlowHeaderDoesNotBlockAccept(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := NewProxyListener(raw, []string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Timeout = 100 * time.Millisecond
+	defer l.Close()
+
+	slow, err := net.Dial("tcp", raw.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	fast, err := net.Dial("tcp", raw.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fast.Close()
+	fast.Write([]byte("PROXY TCP4 192.0.2.7 198.51.100.1 1000 80\r\n"))
+
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	expect(t, c.RemoteAddr().String(), "192.0.2.7:1000")
+	expect(t, c.LocalAddr().String(), "198.51.100.1:80")
+	expect(t, c.(*ProxyConn).Header().Version, 1)
+}
+
+func TestNewProxyListenerInvalidCIDR(t *testing.T) {
+	_, err := NewProxyListener(nil, []string{"10.0.0.0/33"})
+	refute(t, err, nil)
+	_, err = NewProxyListener(nil, []string{"example.com"})
+	refute(t, err, nil)
+}
@@ -0,0 +1,251 @@
+package vermouth
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ClientAddrCtxKey is a key to be used when the ClientAddr resolved by RealIP is bound to context object.
+var ClientAddrCtxKey = "vermouth.ClientAddr"
+
+// ClientAddr is the origin of a request as resolved by RealIP.
+type ClientAddr struct {
+	// IP is the address of the client.
+	IP net.IP
+
+	// Scheme and Host are those of the URL requested by the client,
+	// e.g. "https" and "example.com" when a proxy terminates TLS.
+	Scheme string
+	Host   string
+}
+
+// GetClientAddr returns the ClientAddr bound to ctx by RealIP, or nil.
+func GetClientAddr(ctx context.Context) *ClientAddr {
+	addr, _ := ctx.Value(ClientAddrCtxKey).(*ClientAddr)
+	return addr
+}
+
+// ClientIP returns the IP address of the client resolved by RealIP, or an
+// empty string.
+func ClientIP(ctx context.Context) string {
+	if addr := GetClientAddr(ctx); addr != nil && addr.IP != nil {
+		return addr.IP.String()
+	}
+	return ""
+}
+
+// NewClientAddrContext returns a copy of ctx which carries addr.
+func NewClientAddrContext(ctx context.Context, addr *ClientAddr) context.Context {
+	return context.WithValue(ctx, ClientAddrCtxKey, addr)
+}
+
+// RealIP is a middleware which resolves the client address of requests
+// passing through reverse proxies, and binds it to the request context.
+//
+// Forwarding headers are only believed when they were sent by a trusted
+// proxy. The address chain of the first present header in Headers is walked
+// from right to left, skipping trusted proxies, and the first untrusted
+// address is the client. The scheme and host are taken from the same hop of
+// a Forwarded header, or from X-Forwarded-Proto and X-Forwarded-Host.
+type RealIP struct {
+	// Trusted lists the networks of the proxies.
+	Trusted []*net.IPNet
+
+	// Headers lists the forwarding headers in order of preference. The
+	// supported headers are "Forwarded", "X-Forwarded-For" and "X-Real-IP".
+	Headers []string
+}
+
+// NewRealIP returns a new RealIP middleware trusting the proxies in the
+// networks in CIDR notation. Plain IP addresses are trusted as single hosts.
+// It panics if a network cannot be parsed.
+func NewRealIP(trusted ...string) *RealIP {
+	nets, err := parseCIDRs(trusted)
+	if err != nil {
+		panic(err)
+	}
+	return &RealIP{
+		Trusted: nets,
+		Headers: []string{"Forwarded", "X-Forwarded-For", "X-Real-IP"},
+	}
+}
+
+func (rip *RealIP) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	next(w, r.WithContext(NewClientAddrContext(r.Context(), rip.Resolve(r))))
+}
+
+// Resolve returns the client address of r.
+func (rip *RealIP) Resolve(r *http.Request) *ClientAddr {
+	addr := &ClientAddr{IP: parseHostIP(r.RemoteAddr), Scheme: "http", Host: r.Host}
+	if r.TLS != nil {
+		addr.Scheme = "https"
+	}
+	if addr.IP == nil || !containsIP(rip.Trusted, addr.IP) {
+		return addr
+	}
+
+	for _, name := range rip.Headers {
+		var hops []forwardedHop
+		switch http.CanonicalHeaderKey(name) {
+		case "Forwarded":
+			hops = parseForwarded(r.Header.Values("Forwarded"))
+		case "X-Forwarded-For":
+			hops = parseXForwardedFor(r.Header)
+		case "X-Real-Ip":
+			if ip := parseHostIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+				hops = []forwardedHop{{ip: ip, proto: lastValue(r.Header, "X-Forwarded-Proto"), host: lastValue(r.Header, "X-Forwarded-Host")}}
+			}
+		}
+		if len(hops) == 0 {
+			continue
+		}
+		hop := rip.client(hops)
+		if hop.ip != nil {
+			addr.IP = hop.ip
+		}
+		if p := strings.ToLower(hop.proto); p == "http" || p == "https" {
+			addr.Scheme = p
+		}
+		if validHost(hop.host) {
+			addr.Host = hop.host
+		}
+		break
+	}
+	return addr
+}
+
+// client walks hops from right to left and returns the first one whose
+// address is not trusted, or the leftmost one.
+func (rip *RealIP) client(hops []forwardedHop) forwardedHop {
+	for i := len(hops) - 1; i >= 0; i-- {
+		if hops[i].ip == nil {
+			// an obfuscated or unknown identifier ends the trusted chain
+			if i < len(hops)-1 {
+				return hops[i+1]
+			}
+			return forwardedHop{proto: hops[i].proto, host: hops[i].host}
+		}
+		if i == 0 || !containsIP(rip.Trusted, hops[i].ip) {
+			return hops[i]
+		}
+	}
+	return forwardedHop{}
+}
+
+type forwardedHop struct {
+	ip    net.IP
+	proto string
+	host  string
+}
+
+// parseForwarded parses RFC 7239 Forwarded header values.
+func parseForwarded(values []string) []forwardedHop {
+	var hops []forwardedHop
+	for _, v := range values {
+		for _, elem := range splitQuoted(v, ',') {
+			var hop forwardedHop
+			for _, pair := range splitQuoted(elem, ';') {
+				i := strings.IndexByte(pair, '=')
+				if i < 0 {
+					continue
+				}
+				key := strings.ToLower(strings.TrimSpace(pair[:i]))
+				value := strings.TrimSpace(pair[i+1:])
+				if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+					value = strings.Replace(value[1:len(value)-1], `\"`, `"`, -1)
+				}
+				switch key {
+				case "for":
+					hop.ip = parseHostIP(value)
+				case "proto":
+					hop.proto = value
+				case "host":
+					hop.host = value
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// parseXForwardedFor parses X-Forwarded-For together with X-Forwarded-Proto
+// and X-Forwarded-Host, which are matched up by position when they list as
+// many values.
+func parseXForwardedFor(h http.Header) []forwardedHop {
+	ips := splitValues(h, "X-Forwarded-For")
+	protos := splitValues(h, "X-Forwarded-Proto")
+	hosts := splitValues(h, "X-Forwarded-Host")
+	hops := make([]forwardedHop, len(ips))
+	for i, ip := range ips {
+		hops[i].ip = parseHostIP(ip)
+		if len(protos) == len(ips) {
+			hops[i].proto = protos[i]
+		} else if len(protos) > 0 {
+			hops[i].proto = protos[len(protos)-1]
+		}
+		if len(hosts) == len(ips) {
+			hops[i].host = hosts[i]
+		} else if len(hosts) > 0 {
+			hops[i].host = hosts[len(hosts)-1]
+		}
+	}
+	return hops
+}
+
+func splitValues(h http.Header, name string) []string {
+	var values []string
+	for _, v := range h.Values(name) {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				values = append(values, s)
+			}
+		}
+	}
+	return values
+}
+
+func lastValue(h http.Header, name string) string {
+	values := splitValues(h, name)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[len(values)-1]
+}
+
+// splitQuoted splits s at sep outside of quoted strings.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseHostIP parses an IP address which may carry a port, with IPv6
+// addresses in brackets when they do.
+func parseHostIP(s string) net.IP {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	if i := strings.IndexByte(s, '%'); i >= 0 {
+		s = s[:i]
+	}
+	return net.ParseIP(s)
+}
+
+func validHost(host string) bool {
+	return host != "" && !strings.ContainsAny(host, " \t/\\@?#")
+}
@@ -0,0 +1,101 @@
+package vermouth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func resolveRealIP(rip *RealIP, remoteAddr string, header http.Header) *ClientAddr {
+	var addr *ClientAddr
+	r, _ := http.NewRequest("GET", "http://backend.internal/", nil)
+	r.RemoteAddr = remoteAddr
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	rip.ServeHTTP(httptest.NewRecorder(), r, func(w http.ResponseWriter, r *http.Request) {
+		addr = GetClientAddr(r.Context())
+	})
+	return addr
+}
+
+func TestRealIPUntrustedRemote(t *testing.T) {
+	rip := NewRealIP("10.0.0.0/8")
+	addr := resolveRealIP(rip, "203.0.113.9:4000", http.Header{
+		"X-Forwarded-For":   {"1.2.3.4"},
+		"X-Forwarded-Proto": {"https"},
+	})
+	expect(t, addr.IP.String(), "203.0.113.9")
+	expect(t, addr.Scheme, "http")
+	expect(t, addr.Host, "backend.internal")
+}
+
+func TestRealIPXForwardedFor(t *testing.T) {
+	rip := NewRealIP("10.0.0.0/8", "192.168.1.1")
+	addr := resolveRealIP(rip, "10.0.0.2:4000", http.Header{
+		"X-Forwarded-For":   {"6.6.6.6, 203.0.113.9", "192.168.1.1"},
+		"X-Forwarded-Proto": {"https"},
+		"X-Forwarded-Host":  {"example.com"},
+	})
+	// the spoofed leftmost entry is ignored
+	expect(t, addr.IP.String(), "203.0.113.9")
+	expect(t, addr.Scheme, "https")
+	expect(t, addr.Host, "example.com")
+
+	// every hop trusted: the leftmost address is the client
+	addr = resolveRealIP(rip, "10.0.0.2:4000", http.Header{"X-Forwarded-For": {"10.1.1.1, 10.2.2.2"}})
+	expect(t, addr.IP.String(), "10.1.1.1")
+}
+
+func TestRealIPForwarded(t *testing.T) {
+	rip := NewRealIP("10.0.0.0/8", "2001:db8::/32")
+	addr := resolveRealIP(rip, "[2001:db8::1]:4000", http.Header{
+		"Forwarded": {`for="[2001:db8:cafe::17]:4711";proto=https;host="example.com", for=10.0.0.5;proto=http`},
+		// lower preference
+		"X-Forwarded-For": {"1.2.3.4"},
+	})
+	expect(t, addr.IP.String(), "2001:db8:cafe::17")
+	expect(t, addr.Scheme, "https")
+	expect(t, addr.Host, "example.com")
+
+	addr = resolveRealIP(rip, "10.0.0.1:4000", http.Header{
+		"Forwarded": {`for=198.51.100.17;proto=https;host=example.com`, `for=10.0.0.5`},
+	})
+	expect(t, addr.IP.String(), "198.51.100.17")
+	expect(t, addr.Scheme, "https")
+	expect(t, addr.Host, "example.com")
+
+	// obfuscated identifiers end the chain at the last trusted proxy
+	addr = resolveRealIP(rip, "10.0.0.1:4000", http.Header{"Forwarded": {`for=_hidden, for=10.0.0.5`}})
+	expect(t, addr.IP.String(), "10.0.0.5")
+}
+
+func TestRealIPHeaderPreference(t *testing.T) {
+	rip := NewRealIP("127.0.0.1")
+	rip.Headers = []string{"X-Real-IP", "X-Forwarded-For"}
+	addr := resolveRealIP(rip, "127.0.0.1:4000", http.Header{
+		"X-Real-Ip":       {"198.51.100.1"},
+		"X-Forwarded-For": {"203.0.113.9"},
+	})
+	expect(t, addr.IP.String(), "198.51.100.1")
+	expect(t, ClientIP(NewClientAddrContext(context.Background(), addr)), "198.51.100.1")
+
+	// invalid values fall through to the next header
+	addr = resolveRealIP(rip, "127.0.0.1:4000", http.Header{
+		"X-Real-Ip":       {"garbage"},
+		"X-Forwarded-For": {"203.0.113.9"},
+	})
+	expect(t, addr.IP.String(), "203.0.113.9")
+}
+
+func TestRealIPRejectsInvalidSchemeAndHost(t *testing.T) {
+	rip := NewRealIP("127.0.0.1")
+	addr := resolveRealIP(rip, "127.0.0.1:4000", http.Header{
+		"X-Forwarded-For":   {"203.0.113.9"},
+		"X-Forwarded-Proto": {"javascript"},
+		"X-Forwarded-Host":  {"evil.com/path"},
+	})
+	expect(t, addr.Scheme, "http")
+	expect(t, addr.Host, "backend.internal")
+}
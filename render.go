@@ -0,0 +1,282 @@
+package vermouth
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrNotAcceptable is returned by Negotiate when no offered encoding is accepted.
+var ErrNotAcceptable = errors.New("vermouth: no acceptable representation")
+
+// JSON writes v encoded as JSON with the status code.
+func JSON(w http.ResponseWriter, status int, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeBody(w, status, "application/json; charset=utf-8", append(b, '\n'))
+}
+
+// XML writes v encoded as XML with the status code.
+func XML(w http.ResponseWriter, status int, v interface{}) error {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeBody(w, status, "application/xml; charset=utf-8", append([]byte(xml.Header), b...))
+}
+
+// Text writes s as plain text with the status code.
+func Text(w http.ResponseWriter, status int, s string) error {
+	return writeBody(w, status, "text/plain; charset=utf-8", []byte(s))
+}
+
+// HTML renders the template name of DefaultTemplates with the status code.
+func HTML(w http.ResponseWriter, status int, name string, data interface{}) error {
+	return DefaultTemplates.Render(w, status, name, data)
+}
+
+// Negotiate writes v with the encoding preferred by the Accept header of r:
+// JSON, XML, or plain text formatted with fmt.Sprint. Without an Accept
+// header JSON is used. If no encoding is acceptable a 406 response is written
+// and ErrNotAcceptable is returned.
+func Negotiate(w http.ResponseWriter, r *http.Request, status int, v interface{}) error {
+	addVary(w.Header(), "Accept")
+	switch NegotiateContentType(r, "application/json", "application/xml", "text/xml", "text/plain") {
+	case "application/json":
+		return JSON(w, status, v)
+	case "application/xml":
+		return XML(w, status, v)
+	case "text/xml":
+		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+		return XML(w, status, v)
+	case "text/plain":
+		return Text(w, status, fmt.Sprint(v))
+	}
+	http.Error(w, http.StatusText(http.StatusNotAcceptable), http.StatusNotAcceptable)
+	return ErrNotAcceptable
+}
+
+// NegotiateContentType returns the offer best matching the Accept header of r,
+// or an empty string if none is acceptable. Offers are listed in order of the
+// server's preference, which breaks ties between equal quality values.
+func NegotiateContentType(r *http.Request, offers ...string) string {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		if len(offers) > 0 {
+			return offers[0]
+		}
+		return ""
+	}
+	ranges := parseAccept(accept)
+	best, bestQ, bestSpec := "", 0.0, -1
+	for _, offer := range offers {
+		for _, ar := range ranges {
+			spec := ar.match(offer)
+			if spec < 0 {
+				continue
+			}
+			if ar.q > bestQ || (ar.q == bestQ && spec > bestSpec) {
+				best, bestQ, bestSpec = offer, ar.q, spec
+			}
+			break
+		}
+	}
+	if bestQ == 0 {
+		return ""
+	}
+	return best
+}
+
+type acceptRange struct {
+	typ, subtype string
+	q            float64
+}
+
+// match returns the specificity of the range for offer, or -1.
+func (ar acceptRange) match(offer string) int {
+	typ, subtype := offer, ""
+	if i := strings.IndexByte(offer, '/'); i >= 0 {
+		typ, subtype = offer[:i], offer[i+1:]
+	}
+	switch {
+	case ar.typ == typ && ar.subtype == subtype:
+		return 2
+	case ar.typ == typ && ar.subtype == "*":
+		return 1
+	case ar.typ == "*" && ar.subtype == "*":
+		return 0
+	}
+	return -1
+}
+
+// parseAccept returns the media ranges of an Accept header, most specific first.
+func parseAccept(header string) []acceptRange {
+	var ranges []acceptRange
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		mt := strings.ToLower(strings.TrimSpace(params[0]))
+		i := strings.IndexByte(mt, '/')
+		if i < 0 {
+			continue
+		}
+		ar := acceptRange{typ: mt[:i], subtype: mt[i+1:], q: 1}
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if q, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					ar.q = q
+				}
+			}
+		}
+		ranges = append(ranges, ar)
+	}
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return specificity(ranges[i]) > specificity(ranges[j])
+	})
+	return ranges
+}
+
+func specificity(ar acceptRange) int {
+	switch {
+	case ar.typ == "*":
+		return 0
+	case ar.subtype == "*":
+		return 1
+	}
+	return 2
+}
+
+// DefaultTemplates is the template registry used by HTML.
+var DefaultTemplates = NewTemplates(os.DirFS("templates"))
+
+// Templates is a registry of HTML templates read from a file system.
+//
+// Each page is parsed together with the Layouts and Partials files. When
+// Layout is set, rendering a page executes that template, which is expected
+// to include the page through {{block "content" .}}, while the page defines
+// {{define "content"}}. Templates are parsed once and cached, unless Reload
+// is set, in which case they are parsed on every render (for development).
+type Templates struct {
+	FS fs.FS
+
+	// Extension is appended to page names. The default is ".html".
+	Extension string
+
+	// Layouts and Partials are glob patterns of files parsed with every page.
+	Layouts  []string
+	Partials []string
+
+	// Layout is the name of the template executed for every page.
+	Layout string
+
+	Funcs  template.FuncMap
+	Reload bool
+
+	mu    sync.RWMutex
+	cache map[string]*template.Template
+}
+
+// NewTemplates returns a new Templates reading from fsys.
+func NewTemplates(fsys fs.FS) *Templates {
+	return &Templates{
+		FS:        fsys,
+		Extension: ".html",
+		cache:     make(map[string]*template.Template),
+	}
+}
+
+// Render executes the page name with data and writes the result with the
+// status code. Nothing is written when the template fails.
+func (t *Templates) Render(w http.ResponseWriter, status int, name string, data interface{}) error {
+	tmpl, err := t.Lookup(name)
+	if err != nil {
+		return err
+	}
+	exec := path.Base(name + t.Extension)
+	if t.Layout != "" {
+		exec = t.Layout
+	}
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, exec, data); err != nil {
+		return err
+	}
+	return writeBody(w, status, "text/html; charset=utf-8", buf.Bytes())
+}
+
+// Lookup returns the parsed page name.
+func (t *Templates) Lookup(name string) (*template.Template, error) {
+	if !t.Reload {
+		t.mu.RLock()
+		tmpl, ok := t.cache[name]
+		t.mu.RUnlock()
+		if ok {
+			return tmpl, nil
+		}
+	}
+	tmpl, err := t.parse(name)
+	if err != nil {
+		return nil, err
+	}
+	if !t.Reload {
+		t.mu.Lock()
+		if t.cache == nil {
+			t.cache = make(map[string]*template.Template)
+		}
+		t.cache[name] = tmpl
+		t.mu.Unlock()
+	}
+	return tmpl, nil
+}
+
+func (t *Templates) parse(name string) (*template.Template, error) {
+	tmpl := template.New(path.Base(name + t.Extension)).Funcs(t.Funcs)
+	for _, pattern := range append(append([]string{}, t.Layouts...), t.Partials...) {
+		files, err := fs.Glob(t.FS, pattern)
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			continue
+		}
+		if tmpl, err = tmpl.ParseFS(t.FS, files...); err != nil {
+			return nil, err
+		}
+	}
+	return tmpl.ParseFS(t.FS, name+t.Extension)
+}
+
+func writeBody(w http.ResponseWriter, status int, contentType string, body []byte) error {
+	h := w.Header()
+	if h.Get("Content-Type") == "" {
+		h.Set("Content-Type", contentType)
+	}
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	_, err := w.Write(body)
+	return err
+}
+
+func addVary(h http.Header, field string) {
+	for _, v := range h["Vary"] {
+		for _, f := range strings.Split(v, ",") {
+			f = strings.TrimSpace(f)
+			if f == "*" || strings.EqualFold(f, field) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", field)
+}
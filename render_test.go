@@ -0,0 +1,74 @@
+package vermouth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestNegotiate(t *testing.T) {
+	v := struct {
+		XMLName struct{} `json:"-" xml:"user"`
+		Name    string   `json:"name" xml:"name"`
+	}{Name: "alice"}
+
+	for _, tc := range []struct {
+		accept, contentType string
+		code                int
+	}{
+		{"", "application/json; charset=utf-8", http.StatusOK},
+		{"text/html, application/xml;q=0.9, */*;q=0.8", "application/xml; charset=utf-8", http.StatusOK},
+		{"text/*", "text/xml", http.StatusOK},
+		{"application/json;q=0.1, text/plain", "text/plain; charset=utf-8", http.StatusOK},
+		{"*/*, application/json;q=0", "application/xml; charset=utf-8", http.StatusOK},
+		{"image/png", "text/plain; charset=utf-8", http.StatusNotAcceptable},
+	} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/", nil)
+		if tc.accept != "" {
+			req.Header.Set("Accept", tc.accept)
+		}
+		rec.Header().Set("Vary", "Accept-Encoding")
+		Negotiate(rec, req, http.StatusOK, v)
+		expect(t, rec.Code, tc.code)
+		if !strings.HasPrefix(rec.Header().Get("Content-Type"), strings.Split(tc.contentType, ";")[0]) {
+			t.Errorf("Accept %q: got Content-Type %q", tc.accept, rec.Header().Get("Content-Type"))
+		}
+		expect(t, strings.Join(rec.Header()["Vary"], ","), "Accept-Encoding,Accept")
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	fsys := fstest.MapFS{
+		"layouts/base.html": {Data: []byte(`<main>{{block "content" .}}{{end}}</main>`)},
+		"users.html":        {Data: []byte(`{{define "content"}}Hello {{.}}{{end}}`)},
+	}
+	tmpls := NewTemplates(fsys)
+	tmpls.Layouts = []string{"layouts/*.html"}
+	tmpls.Layout = "base.html"
+
+	rec := httptest.NewRecorder()
+	if err := tmpls.Render(rec, http.StatusCreated, "users", "<bob>"); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, rec.Code, http.StatusCreated)
+	expect(t, rec.Body.String(), "<main>Hello &lt;bob&gt;</main>")
+	expect(t, rec.Header().Get("Content-Type"), "text/html; charset=utf-8")
+
+	// cached templates ignore changes, reloading templates pick them up
+	fsys["users.html"] = &fstest.MapFile{Data: []byte(`{{define "content"}}Bye {{.}}{{end}}`)}
+	rec = httptest.NewRecorder()
+	tmpls.Render(rec, http.StatusOK, "users", "bob")
+	expect(t, rec.Body.String(), "<main>Hello bob</main>")
+
+	tmpls.Reload = true
+	rec = httptest.NewRecorder()
+	tmpls.Render(rec, http.StatusOK, "users", "bob")
+	expect(t, rec.Body.String(), "<main>Bye bob</main>")
+
+	rec = httptest.NewRecorder()
+	refute(t, tmpls.Render(rec, http.StatusOK, "missing", nil), nil)
+	expect(t, rec.Body.Len(), 0)
+}
@@ -2,7 +2,7 @@ package vermouth
 
 import (
 	"bufio"
-	"fmt"
+	"io"
 	"net"
 	"net/http"
 )
@@ -10,49 +10,85 @@ import (
 // ResponseWriter is a wrapper around http.ResponseWriter that provides extra information about
 // the response. It is recommended that middleware handlers use this construct to wrap a responsewriter
 // if the functionality calls for it.
+//
+// A ResponseWriter implements exactly those of http.Flusher, http.Hijacker, http.CloseNotifier,
+// http.Pusher and io.ReaderFrom which the wrapped http.ResponseWriter implements, and unwraps to it
+// for http.ResponseController.
 type ResponseWriter interface {
 	http.ResponseWriter
-	http.Flusher
 	// Status returns the status code of the response or 0 if the response has not been written.
 	Status() int
-	// Written returns whether or not the ResponseWriter has been written.
+	// Written returns whether or not the response header has been written.
 	Written() bool
+	// BodyWritten returns whether or not Write has been called.
+	BodyWritten() bool
 	// Size returns the size of the response body.
 	Size() int
 	// Before allows for a function to be called before the ResponseWriter has been written to. This is
 	// useful for setting headers or any other operations that must happen before a response has been written.
+	// The functions run exactly once, in reverse order of registration.
 	Before(func(ResponseWriter))
+	// After allows for a function to be called once the middleware stack has returned, also when a
+	// handler panicked. This is useful for metrics, audit logs and cleanup. The functions run
+	// exactly once, in reverse order of registration.
+	After(func(ResponseWriter))
+	// OnFlush allows for a function to be called after each flush of the response.
+	OnFlush(func(ResponseWriter))
+	// OnHijack allows for a function to be called after the connection has been hijacked.
+	OnHijack(func(ResponseWriter))
+	// Unwrap returns the wrapped http.ResponseWriter.
+	Unwrap() http.ResponseWriter
 }
 
 type beforeFunc func(ResponseWriter)
 
 // NewResponseWriter creates a ResponseWriter that wraps an http.ResponseWriter
 func NewResponseWriter(w http.ResponseWriter) ResponseWriter {
-	return &responseWriter{
-		ResponseWriter: w,
-		status:         http.StatusOK,
-		size:           0,
-		beforeFuncs:    nil}
+	return newResponseWriter(w).outer
+}
+
+func newResponseWriter(w http.ResponseWriter) *responseWriter {
+	rw := &responseWriter{ResponseWriter: w}
+	rw.outer = rw.wrap()
+	return rw
 }
 
 type responseWriter struct {
 	http.ResponseWriter
+	outer       ResponseWriter
 	status      int
 	size        int
+	wroteHeader bool
+	wroteBody   bool
 	beforeFuncs []beforeFunc
+	afterFuncs  []beforeFunc
+	flushFuncs  []beforeFunc
+	hijackFuncs []beforeFunc
+	calledAfter bool
 }
 
+// WriteHeader runs the Before functions and writes the header. Informational
+// 1xx headers are passed through, and calls after the header has been
+// written, including those made by Before functions, are ignored.
 func (w *responseWriter) WriteHeader(s int) {
+	if w.wroteHeader {
+		return
+	}
+	if s >= 100 && s < 200 && s != http.StatusSwitchingProtocols {
+		w.ResponseWriter.WriteHeader(s)
+		return
+	}
+	w.wroteHeader = true
 	w.status = s
 	w.callBefore()
 	w.ResponseWriter.WriteHeader(s)
 }
 
 func (w *responseWriter) Write(b []byte) (int, error) {
-	if !w.Written() {
-		// The status will be StatusOK if WriteHeader has not been called yet
+	if !w.wroteHeader {
 		w.WriteHeader(http.StatusOK)
 	}
+	w.wroteBody = true
 	size, err := w.ResponseWriter.Write(b)
 	w.size += size
 	return size, err
@@ -67,34 +103,339 @@ func (w *responseWriter) Size() int {
 }
 
 func (w *responseWriter) Written() bool {
-	return w.status != 0
+	return w.wroteHeader
+}
+
+func (w *responseWriter) BodyWritten() bool {
+	return w.wroteBody
 }
 
 func (w *responseWriter) Before(before func(ResponseWriter)) {
 	w.beforeFuncs = append(w.beforeFuncs, before)
 }
 
-func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
-	hijacker, ok := w.ResponseWriter.(http.Hijacker)
-	if !ok {
-		return nil, nil, fmt.Errorf("the ResponseWriter doesn't support the Hijacker interface")
-	}
-	return hijacker.Hijack()
+func (w *responseWriter) After(after func(ResponseWriter)) {
+	w.afterFuncs = append(w.afterFuncs, after)
+}
+
+func (w *responseWriter) OnFlush(f func(ResponseWriter)) {
+	w.flushFuncs = append(w.flushFuncs, f)
 }
 
-func (w *responseWriter) CloseNotify() <-chan bool {
-	return w.ResponseWriter.(http.CloseNotifier).CloseNotify()
+func (w *responseWriter) OnHijack(f func(ResponseWriter)) {
+	w.hijackFuncs = append(w.hijackFuncs, f)
+}
+
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// callAfter runs the After functions, unless they already ran.
+func (w *responseWriter) callAfter() {
+	if w.calledAfter {
+		return
+	}
+	w.calledAfter = true
+	for i := len(w.afterFuncs) - 1; i >= 0; i-- {
+		w.afterFuncs[i](w.outer)
+	}
 }
 
 func (w *responseWriter) callBefore() {
 	for i := len(w.beforeFuncs) - 1; i >= 0; i-- {
-		w.beforeFuncs[i](w)
+		w.beforeFuncs[i](w.outer)
 	}
 }
 
-func (w *responseWriter) Flush() {
-	flusher, ok := w.ResponseWriter.(http.Flusher)
-	if ok {
-		flusher.Flush()
+// The optional interfaces are implemented by separate types, which are
+// embedded next to responseWriter by wrap as far as the wrapped
+// http.ResponseWriter implements them.
+
+type flusher struct{ w *responseWriter }
+
+func (f flusher) Flush() {
+	w := f.w
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.ResponseWriter.(http.Flusher).Flush()
+	for _, fn := range w.flushFuncs {
+		fn(w.outer)
+	}
+}
+
+type hijacker struct{ w *responseWriter }
+
+func (h hijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w := h.w
+	conn, rw, err := w.ResponseWriter.(http.Hijacker).Hijack()
+	if err == nil {
+		for _, fn := range w.hijackFuncs {
+			fn(w.outer)
+		}
+	}
+	return conn, rw, err
+}
+
+type closeNotifier struct{ w *responseWriter }
+
+func (c closeNotifier) CloseNotify() <-chan bool {
+	return c.w.ResponseWriter.(http.CloseNotifier).CloseNotify()
+}
+
+type pusher struct{ w *responseWriter }
+
+func (p pusher) Push(target string, opts *http.PushOptions) error {
+	return p.w.ResponseWriter.(http.Pusher).Push(target, opts)
+}
+
+type readerFrom struct{ w *responseWriter }
+
+func (rf readerFrom) ReadFrom(r io.Reader) (int64, error) {
+	w := rf.w
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.wroteBody = true
+	n, err := w.ResponseWriter.(io.ReaderFrom).ReadFrom(r)
+	w.size += int(n)
+	return n, err
+}
+
+const (
+	implFlusher = 1 << iota
+	implHijacker
+	implCloseNotifier
+	implPusher
+	implReaderFrom
+)
+
+// wrap returns w combined with the optional interfaces of the wrapped writer.
+func (w *responseWriter) wrap() ResponseWriter {
+	var impl int
+	if _, ok := w.ResponseWriter.(http.Flusher); ok {
+		impl |= implFlusher
+	}
+	if _, ok := w.ResponseWriter.(http.Hijacker); ok {
+		impl |= implHijacker
+	}
+	if _, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		impl |= implCloseNotifier
+	}
+	if _, ok := w.ResponseWriter.(http.Pusher); ok {
+		impl |= implPusher
+	}
+	if _, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		impl |= implReaderFrom
+	}
+
+	f, h, c, p, r := flusher{w}, hijacker{w}, closeNotifier{w}, pusher{w}, readerFrom{w}
+	switch impl {
+	case 0:
+		return w
+	case implFlusher:
+		return struct {
+			*responseWriter
+			flusher
+		}{w, f}
+	case implHijacker:
+		return struct {
+			*responseWriter
+			hijacker
+		}{w, h}
+	case implFlusher | implHijacker:
+		return struct {
+			*responseWriter
+			flusher
+			hijacker
+		}{w, f, h}
+	case implCloseNotifier:
+		return struct {
+			*responseWriter
+			closeNotifier
+		}{w, c}
+	case implFlusher | implCloseNotifier:
+		return struct {
+			*responseWriter
+			flusher
+			closeNotifier
+		}{w, f, c}
+	case implHijacker | implCloseNotifier:
+		return struct {
+			*responseWriter
+			hijacker
+			closeNotifier
+		}{w, h, c}
+	case implFlusher | implHijacker | implCloseNotifier:
+		return struct {
+			*responseWriter
+			flusher
+			hijacker
+			closeNotifier
+		}{w, f, h, c}
+	case implPusher:
+		return struct {
+			*responseWriter
+			pusher
+		}{w, p}
+	case implFlusher | implPusher:
+		return struct {
+			*responseWriter
+			flusher
+			pusher
+		}{w, f, p}
+	case implHijacker | implPusher:
+		return struct {
+			*responseWriter
+			hijacker
+			pusher
+		}{w, h, p}
+	case implFlusher | implHijacker | implPusher:
+		return struct {
+			*responseWriter
+			flusher
+			hijacker
+			pusher
+		}{w, f, h, p}
+	case implCloseNotifier | implPusher:
+		return struct {
+			*responseWriter
+			closeNotifier
+			pusher
+		}{w, c, p}
+	case implFlusher | implCloseNotifier | implPusher:
+		return struct {
+			*responseWriter
+			flusher
+			closeNotifier
+			pusher
+		}{w, f, c, p}
+	case implHijacker | implCloseNotifier | implPusher:
+		return struct {
+			*responseWriter
+			hijacker
+			closeNotifier
+			pusher
+		}{w, h, c, p}
+	case implFlusher | implHijacker | implCloseNotifier | implPusher:
+		return struct {
+			*responseWriter
+			flusher
+			hijacker
+			closeNotifier
+			pusher
+		}{w, f, h, c, p}
+	case implReaderFrom:
+		return struct {
+			*responseWriter
+			readerFrom
+		}{w, r}
+	case implFlusher | implReaderFrom:
+		return struct {
+			*responseWriter
+			flusher
+			readerFrom
+		}{w, f, r}
+	case implHijacker | implReaderFrom:
+		return struct {
+			*responseWriter
+			hijacker
+			readerFrom
+		}{w, h, r}
+	case implFlusher | implHijacker | implReaderFrom:
+		return struct {
+			*responseWriter
+			flusher
+			hijacker
+			readerFrom
+		}{w, f, h, r}
+	case implCloseNotifier | implReaderFrom:
+		return struct {
+			*responseWriter
+			closeNotifier
+			readerFrom
+		}{w, c, r}
+	case implFlusher | implCloseNotifier | implReaderFrom:
+		return struct {
+			*responseWriter
+			flusher
+			closeNotifier
+			readerFrom
+		}{w, f, c, r}
+	case implHijacker | implCloseNotifier | implReaderFrom:
+		return struct {
+			*responseWriter
+			hijacker
+			closeNotifier
+			readerFrom
+		}{w, h, c, r}
+	case implFlusher | implHijacker | implCloseNotifier | implReaderFrom:
+		return struct {
+			*responseWriter
+			flusher
+			hijacker
+			closeNotifier
+			readerFrom
+		}{w, f, h, c, r}
+	case implPusher | implReaderFrom:
+		return struct {
+			*responseWriter
+			pusher
+			readerFrom
+		}{w, p, r}
+	case implFlusher | implPusher | implReaderFrom:
+		return struct {
+			*responseWriter
+			flusher
+			pusher
+			readerFrom
+		}{w, f, p, r}
+	case implHijacker | implPusher | implReaderFrom:
+		return struct {
+			*responseWriter
+			hijacker
+			pusher
+			readerFrom
+		}{w, h, p, r}
+	case implFlusher | implHijacker | implPusher | implReaderFrom:
+		return struct {
+			*responseWriter
+			flusher
+			hijacker
+			pusher
+			readerFrom
+		}{w, f, h, p, r}
+	case implCloseNotifier | implPusher | implReaderFrom:
+		return struct {
+			*responseWriter
+			closeNotifier
+			pusher
+			readerFrom
+		}{w, c, p, r}
+	case implFlusher | implCloseNotifier | implPusher | implReaderFrom:
+		return struct {
+			*responseWriter
+			flusher
+			closeNotifier
+			pusher
+			readerFrom
+		}{w, f, c, p, r}
+	case implHijacker | implCloseNotifier | implPusher | implReaderFrom:
+		return struct {
+			*responseWriter
+			hijacker
+			closeNotifier
+			pusher
+			readerFrom
+		}{w, h, c, p, r}
+	default:
+		return struct {
+			*responseWriter
+			flusher
+			hijacker
+			closeNotifier
+			pusher
+			readerFrom
+		}{w, f, h, c, p, r}
 	}
 }
@@ -2,9 +2,13 @@ package vermouth
 
 import (
 	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -120,11 +124,8 @@ func TestResponseWriterHijack(t *testing.T) {
 func TestResponseWriteHijackNotOK(t *testing.T) {
 	hijackable := new(http.ResponseWriter)
 	w := NewResponseWriter(*hijackable)
-	hijacker, ok := w.(http.Hijacker)
-	expect(t, ok, true)
-	_, _, err := hijacker.Hijack()
-
-	refute(t, err, nil)
+	_, ok := w.(http.Hijacker)
+	expect(t, ok, false)
 }
 
 func TestResponseWriterCloseNotify(t *testing.T) {
@@ -148,3 +149,530 @@ func TestResponseWriterFlusher(t *testing.T) {
 	_, ok := w.(http.Flusher)
 	expect(t, ok, true)
 }
+
+func TestResponseWriterNotWritten(t *testing.T) {
+	w := NewResponseWriter(httptest.NewRecorder())
+
+	expect(t, w.Status(), 0)
+	expect(t, w.Written(), false)
+	expect(t, w.BodyWritten(), false)
+	expect(t, w.Size(), 0)
+}
+
+func TestResponseWriterWriteRunsBefore(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := NewResponseWriter(rec)
+	calls := 0
+	w.Before(func(w ResponseWriter) {
+		calls++
+		w.Header().Set("X-Before", "yes")
+	})
+
+	w.Write([]byte("Hello"))
+	w.Write([]byte(" world"))
+
+	expect(t, calls, 1)
+	expect(t, rec.Header().Get("X-Before"), "yes")
+	expect(t, w.Status(), http.StatusOK)
+	expect(t, w.Written(), true)
+	expect(t, w.BodyWritten(), true)
+}
+
+func TestResponseWriterWriteHeaderWithoutBody(t *testing.T) {
+	w := NewResponseWriter(httptest.NewRecorder())
+
+	w.WriteHeader(http.StatusNoContent)
+
+	expect(t, w.Written(), true)
+	expect(t, w.BodyWritten(), false)
+}
+
+func TestResponseWriterSuperfluousWriteHeader(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := NewResponseWriter(rec)
+	calls := 0
+	w.Before(func(ResponseWriter) {
+		calls++
+	})
+
+	w.WriteHeader(http.StatusCreated)
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write([]byte("body"))
+
+	expect(t, calls, 1)
+	expect(t, rec.Code, http.StatusCreated)
+	expect(t, w.Status(), http.StatusCreated)
+}
+
+func TestResponseWriterWriteHeaderInBefore(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := NewResponseWriter(rec)
+	calls := 0
+	w.Before(func(w ResponseWriter) {
+		calls++
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	w.WriteHeader(http.StatusAccepted)
+
+	expect(t, calls, 1)
+	expect(t, rec.Code, http.StatusAccepted)
+}
+
+func TestResponseWriterInformationalHeader(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := NewResponseWriter(rec)
+	calls := 0
+	w.Before(func(ResponseWriter) {
+		calls++
+	})
+
+	w.WriteHeader(http.StatusEarlyHints)
+	expect(t, calls, 0)
+	expect(t, w.Written(), false)
+	expect(t, w.Status(), 0)
+
+	w.WriteHeader(http.StatusOK)
+	expect(t, calls, 1)
+	expect(t, w.Status(), http.StatusOK)
+}
+
+func TestResponseWriterFlushWritesHeader(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := NewResponseWriter(rec)
+	calls := 0
+	w.Before(func(ResponseWriter) {
+		calls++
+	})
+
+	w.(http.Flusher).Flush()
+
+	expect(t, calls, 1)
+	expect(t, w.Status(), http.StatusOK)
+	expect(t, rec.Flushed, true)
+}
+
+func TestResponseWriterAfter(t *testing.T) {
+	result := ""
+	vm := New()
+	vm.Use("", HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		w.(ResponseWriter).After(func(w ResponseWriter) {
+			result += "foo"
+			expect(t, w.Status(), http.StatusCreated)
+			expect(t, w.Size(), 2)
+		})
+		w.(ResponseWriter).After(func(ResponseWriter) {
+			result += "bar"
+		})
+		next(w, r)
+		result += "ban"
+	}))
+	vm.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("ok"))
+	})
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	vm.ServeHTTP(httptest.NewRecorder(), req)
+	expect(t, result, "banbarfoo")
+
+	// the handler returned by HandlerFunc runs them as well
+	result = ""
+	vm.HandlerFunc()(httptest.NewRecorder(), req)
+	expect(t, result, "banbarfoo")
+}
+
+func TestResponseWriterAfterOnPanic(t *testing.T) {
+	calls := 0
+	vm := New()
+	vm.Use("", HandlerFunc(func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		w.(ResponseWriter).After(func(ResponseWriter) {
+			calls++
+		})
+		next(w, r)
+	}))
+	vm.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	func() {
+		defer func() {
+			expect(t, recover(), "boom")
+		}()
+		vm.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	expect(t, calls, 1)
+
+	// recovered by the router
+	calls = 0
+	vm.router.PanicHandler = func(w http.ResponseWriter, r *http.Request, rcv interface{}) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	vm.ServeHTTP(httptest.NewRecorder(), req)
+	expect(t, calls, 1)
+}
+
+func TestResponseWriterOnFlush(t *testing.T) {
+	w := NewResponseWriter(httptest.NewRecorder())
+	flushes := 0
+	w.OnFlush(func(ResponseWriter) {
+		flushes++
+	})
+
+	w.(http.Flusher).Flush()
+	w.(http.Flusher).Flush()
+
+	expect(t, flushes, 2)
+}
+
+func TestResponseWriterOnHijack(t *testing.T) {
+	w := NewResponseWriter(newHijackableResponse())
+	hijacked := false
+	w.OnHijack(func(ResponseWriter) {
+		hijacked = true
+	})
+
+	w.(http.Hijacker).Hijack()
+
+	expect(t, hijacked, true)
+
+	w = NewResponseWriter(&hijackFailingResponse{})
+	hijacked = false
+	w.OnHijack(func(ResponseWriter) {
+		hijacked = true
+	})
+	_, _, err := w.(http.Hijacker).Hijack()
+	refute(t, err, nil)
+	expect(t, hijacked, false)
+}
+
+// plainWriter implements none of the optional interfaces; the m* types add
+// them one by one and record their calls.
+type plainWriter struct {
+	header http.Header
+	calls  []string
+}
+
+func (w *plainWriter) Header() http.Header         { return w.header }
+func (w *plainWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *plainWriter) WriteHeader(int)             {}
+
+type mFlusher struct{ w *plainWriter }
+
+func (m mFlusher) Flush() { m.w.calls = append(m.w.calls, "Flush") }
+
+type mHijacker struct{ w *plainWriter }
+
+func (m mHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	m.w.calls = append(m.w.calls, "Hijack")
+	return nil, nil, nil
+}
+
+type mCloseNotifier struct{ w *plainWriter }
+
+func (m mCloseNotifier) CloseNotify() <-chan bool {
+	m.w.calls = append(m.w.calls, "CloseNotify")
+	return nil
+}
+
+type mPusher struct{ w *plainWriter }
+
+func (m mPusher) Push(string, *http.PushOptions) error {
+	m.w.calls = append(m.w.calls, "Push")
+	return nil
+}
+
+type mReaderFrom struct{ w *plainWriter }
+
+func (m mReaderFrom) ReadFrom(r io.Reader) (int64, error) {
+	m.w.calls = append(m.w.calls, "ReadFrom")
+	return io.Copy(ioutil.Discard, r)
+}
+
+// newMatrixWriter returns a writer implementing the optional interfaces
+// selected by the bits of impl, in the order of the impl* constants.
+func newMatrixWriter(impl int) (http.ResponseWriter, *plainWriter) {
+	b := &plainWriter{header: make(http.Header)}
+	f, h, c, p, r := mFlusher{b}, mHijacker{b}, mCloseNotifier{b}, mPusher{b}, mReaderFrom{b}
+	var w http.ResponseWriter
+	switch impl {
+	case 0:
+		w = b
+	case 1:
+		w = struct {
+			*plainWriter
+			mFlusher
+		}{b, f}
+	case 2:
+		w = struct {
+			*plainWriter
+			mHijacker
+		}{b, h}
+	case 3:
+		w = struct {
+			*plainWriter
+			mFlusher
+			mHijacker
+		}{b, f, h}
+	case 4:
+		w = struct {
+			*plainWriter
+			mCloseNotifier
+		}{b, c}
+	case 5:
+		w = struct {
+			*plainWriter
+			mFlusher
+			mCloseNotifier
+		}{b, f, c}
+	case 6:
+		w = struct {
+			*plainWriter
+			mHijacker
+			mCloseNotifier
+		}{b, h, c}
+	case 7:
+		w = struct {
+			*plainWriter
+			mFlusher
+			mHijacker
+			mCloseNotifier
+		}{b, f, h, c}
+	case 8:
+		w = struct {
+			*plainWriter
+			mPusher
+		}{b, p}
+	case 9:
+		w = struct {
+			*plainWriter
+			mFlusher
+			mPusher
+		}{b, f, p}
+	case 10:
+		w = struct {
+			*plainWriter
+			mHijacker
+			mPusher
+		}{b, h, p}
+	case 11:
+		w = struct {
+			*plainWriter
+			mFlusher
+			mHijacker
+			mPusher
+		}{b, f, h, p}
+	case 12:
+		w = struct {
+			*plainWriter
+			mCloseNotifier
+			mPusher
+		}{b, c, p}
+	case 13:
+		w = struct {
+			*plainWriter
+			mFlusher
+			mCloseNotifier
+			mPusher
+		}{b, f, c, p}
+	case 14:
+		w = struct {
+			*plainWriter
+			mHijacker
+			mCloseNotifier
+			mPusher
+		}{b, h, c, p}
+	case 15:
+		w = struct {
+			*plainWriter
+			mFlusher
+			mHijacker
+			mCloseNotifier
+			mPusher
+		}{b, f, h, c, p}
+	case 16:
+		w = struct {
+			*plainWriter
+			mReaderFrom
+		}{b, r}
+	case 17:
+		w = struct {
+			*plainWriter
+			mFlusher
+			mReaderFrom
+		}{b, f, r}
+	case 18:
+		w = struct {
+			*plainWriter
+			mHijacker
+			mReaderFrom
+		}{b, h, r}
+	case 19:
+		w = struct {
+			*plainWriter
+			mFlusher
+			mHijacker
+			mReaderFrom
+		}{b, f, h, r}
+	case 20:
+		w = struct {
+			*plainWriter
+			mCloseNotifier
+			mReaderFrom
+		}{b, c, r}
+	case 21:
+		w = struct {
+			*plainWriter
+			mFlusher
+			mCloseNotifier
+			mReaderFrom
+		}{b, f, c, r}
+	case 22:
+		w = struct {
+			*plainWriter
+			mHijacker
+			mCloseNotifier
+			mReaderFrom
+		}{b, h, c, r}
+	case 23:
+		w = struct {
+			*plainWriter
+			mFlusher
+			mHijacker
+			mCloseNotifier
+			mReaderFrom
+		}{b, f, h, c, r}
+	case 24:
+		w = struct {
+			*plainWriter
+			mPusher
+			mReaderFrom
+		}{b, p, r}
+	case 25:
+		w = struct {
+			*plainWriter
+			mFlusher
+			mPusher
+			mReaderFrom
+		}{b, f, p, r}
+	case 26:
+		w = struct {
+			*plainWriter
+			mHijacker
+			mPusher
+			mReaderFrom
+		}{b, h, p, r}
+	case 27:
+		w = struct {
+			*plainWriter
+			mFlusher
+			mHijacker
+			mPusher
+			mReaderFrom
+		}{b, f, h, p, r}
+	case 28:
+		w = struct {
+			*plainWriter
+			mCloseNotifier
+			mPusher
+			mReaderFrom
+		}{b, c, p, r}
+	case 29:
+		w = struct {
+			*plainWriter
+			mFlusher
+			mCloseNotifier
+			mPusher
+			mReaderFrom
+		}{b, f, c, p, r}
+	case 30:
+		w = struct {
+			*plainWriter
+			mHijacker
+			mCloseNotifier
+			mPusher
+			mReaderFrom
+		}{b, h, c, p, r}
+	case 31:
+		w = struct {
+			*plainWriter
+			mFlusher
+			mHijacker
+			mCloseNotifier
+			mPusher
+			mReaderFrom
+		}{b, f, h, c, p, r}
+	}
+	return w, b
+}
+
+func TestResponseWriterOptionalInterfaces(t *testing.T) {
+	for impl := 0; impl < 32; impl++ {
+		under, base := newMatrixWriter(impl)
+		w := NewResponseWriter(under)
+
+		var calls []string
+		f, ok := w.(http.Flusher)
+		expect(t, ok, impl&implFlusher != 0)
+		if ok {
+			f.Flush()
+			calls = append(calls, "Flush")
+		}
+		h, ok := w.(http.Hijacker)
+		expect(t, ok, impl&implHijacker != 0)
+		if ok {
+			h.Hijack()
+			calls = append(calls, "Hijack")
+		}
+		c, ok := w.(http.CloseNotifier)
+		expect(t, ok, impl&implCloseNotifier != 0)
+		if ok {
+			c.CloseNotify()
+			calls = append(calls, "CloseNotify")
+		}
+		p, ok := w.(http.Pusher)
+		expect(t, ok, impl&implPusher != 0)
+		if ok {
+			p.Push("/style.css", nil)
+			calls = append(calls, "Push")
+		}
+		rf, ok := w.(io.ReaderFrom)
+		expect(t, ok, impl&implReaderFrom != 0)
+		if ok {
+			rf.ReadFrom(strings.NewReader("hello"))
+			calls = append(calls, "ReadFrom")
+			expect(t, w.Size(), 5)
+			expect(t, w.BodyWritten(), true)
+		}
+		expect(t, strings.Join(base.calls, ","), strings.Join(calls, ","))
+		expect(t, w.Unwrap(), under)
+	}
+}
+
+func TestResponseWriterResponseController(t *testing.T) {
+	under, base := newMatrixWriter(implHijacker)
+	rc := http.NewResponseController(NewResponseWriter(under))
+
+	expect(t, errors.Is(rc.Flush(), http.ErrNotSupported), true)
+	rc.Hijack()
+	expect(t, strings.Join(base.calls, ","), "Hijack")
+
+	under, base = newMatrixWriter(implFlusher)
+	w := NewResponseWriter(under)
+	flushed := false
+	w.OnFlush(func(ResponseWriter) {
+		flushed = true
+	})
+	expect(t, http.NewResponseController(w).Flush(), nil)
+	expect(t, flushed, true)
+	expect(t, strings.Join(base.calls, ","), "Flush")
+}
+
+type hijackFailingResponse struct {
+	plainWriter
+}
+
+func (h *hijackFailingResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, errors.New("hijack failed")
+}
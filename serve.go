@@ -1,30 +1,360 @@
 package vermouth
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"net"
-
-	"github.com/tylerb/graceful"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 )
 
+// Server is an http.Server with a graceful shutdown lifecycle.
+// When it is stopped, it stops accepting connections, waits up to Timeout for
+// outstanding requests to finish, and closes the remaining connections.
+type Server struct {
+	*http.Server
+
+	// Timeout is the duration to allow outstanding requests to survive
+	// before forcefully terminating them. If zero, Stop waits indefinitely.
+	Timeout time.Duration
+
+	// Limit the number of outstanding connections.
+	ListenLimit int
+
+	// ShutdownInitiated is an optional callback function that is called
+	// once when shutdown is initiated. Stop waits for it to return before
+	// draining the connections.
+	ShutdownInitiated func()
+
+	// NoSignalHandling prevents the server from automatically shutting down
+	// on SIGINT and SIGTERM.
+	NoSignalHandling bool
+
+	hookOnce      sync.Once
+	initiatedOnce sync.Once
+	webSockets    *webSocketRegistry
+	mu            sync.Mutex
+	stopping      bool
+	deadline      time.Time
+	stopped       chan struct{}
+	stopErr       error
+}
+
+// Serve accepts connections on l until the server is stopped.
+// After a graceful stop Serve returns nil once outstanding requests have
+// finished, or the error which ended the shutdown, e.g. when Timeout expired.
+func (srv *Server) Serve(l net.Listener) error {
+	return srv.serve(l, srv.Server.Serve)
+}
+
+// ServeTLS is like Serve, but accepts TLS connections. certFile and keyFile
+// may be empty when srv.TLSConfig provides the certificates.
+func (srv *Server) ServeTLS(l net.Listener, certFile, keyFile string) error {
+	return srv.serve(l, func(l net.Listener) error {
+		return srv.Server.ServeTLS(l, certFile, keyFile)
+	})
+}
+
+func (srv *Server) serve(l net.Listener, serve func(net.Listener) error) error {
+	if srv.ListenLimit > 0 {
+		l = newLimitListener(l, srv.ListenLimit)
+	}
+	// serve runs once per listener, the hooks only once per server
+	srv.hookOnce.Do(srv.setup)
+	if !srv.NoSignalHandling {
+		srv.handleSignals()
+	}
+
+	err := serve(l)
+	if err != http.ErrServerClosed {
+		return err
+	}
+	srv.mu.Lock()
+	stopping := srv.stopping
+	srv.mu.Unlock()
+	if !stopping {
+		// closed directly through http.Server
+		return nil
+	}
+	<-srv.StopChan()
+	return srv.stopErr
+}
+
+// ListenAndServe listens on the address srv.Addr, in one of the formats
+// accepted by Listen, and then calls Serve to handle requests on incoming
+// connections.
+func (srv *Server) ListenAndServe() error {
+	l, err := Listen(srv.Addr)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(l)
+}
+
+// Stop initiates a graceful shutdown which lasts at most timeout, or
+// indefinitely if timeout is zero. Open WebSockets are sent a close frame and
+// are waited for as well, at most WebSocketCloseTimeout. It does not wait for
+// the shutdown to complete; use StopChan for that. Calling Stop more than
+// once has no effect.
+func (srv *Server) Stop(timeout time.Duration) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.stopping {
+		return
+	}
+	srv.stopping = true
+	if timeout > 0 {
+		srv.deadline = time.Now().Add(timeout)
+	}
+	stopped := srv.stopChan()
+
+	go func() {
+		// ShutdownInitiated runs before the connections are drained, so
+		// that what it says to clients goes out before Serve returns
+		srv.initiateShutdown()
+		ctx, cancel := srv.shutdownContext()
+		defer cancel()
+		// hijacked WebSockets are not seen by Shutdown; they are sent a
+		// close frame and waited for separately
+		srv.mu.Lock()
+		webSockets := srv.webSockets
+		srv.mu.Unlock()
+		if webSockets != nil {
+			webSockets.shutdown()
+		}
+		err := srv.Shutdown(ctx)
+		if webSockets != nil {
+			if werr := webSockets.wait(ctx); err == nil {
+				err = werr
+			}
+		}
+		if err != nil {
+			srv.Close()
+		}
+		srv.stopErr = err
+		close(stopped)
+	}()
+}
+
+// setup registers the shutdown hooks, which also run when the embedded
+// http.Server is shut down directly, and tracks the WebSockets upgraded from
+// the connections of the server.
+func (srv *Server) setup() {
+	srv.mu.Lock()
+	srv.webSockets = newWebSocketRegistry()
+	srv.mu.Unlock()
+	connContext := srv.ConnContext
+	srv.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		if connContext != nil {
+			ctx = connContext(ctx, c)
+		}
+		return context.WithValue(ctx, webSocketsCtxKey, srv.webSockets)
+	}
+	srv.RegisterOnShutdown(srv.initiateShutdown)
+	srv.RegisterOnShutdown(srv.webSockets.shutdown)
+}
+
+// initiateShutdown calls ShutdownInitiated, once.
+func (srv *Server) initiateShutdown() {
+	srv.initiatedOnce.Do(func() {
+		if srv.ShutdownInitiated != nil {
+			srv.ShutdownInitiated()
+		}
+	})
+}
+
+// StopChan returns a channel which is closed once the server has stopped.
+func (srv *Server) StopChan() <-chan struct{} {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.stopChan()
+}
+
+func (srv *Server) stopChan() chan struct{} {
+	if srv.stopped == nil {
+		srv.stopped = make(chan struct{})
+	}
+	return srv.stopped
+}
+
+// shutdownContext returns a context bound by the deadline of the graceful
+// shutdown, which is shared by draining connections and shutdown hooks.
+func (srv *Server) shutdownContext() (context.Context, context.CancelFunc) {
+	srv.mu.Lock()
+	deadline, stopping := srv.deadline, srv.stopping
+	srv.mu.Unlock()
+	switch {
+	case !deadline.IsZero():
+		return context.WithDeadline(context.Background(), deadline)
+	case !stopping && srv.Timeout > 0:
+		return context.WithTimeout(context.Background(), srv.Timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+func (srv *Server) handleSignals() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	stopped := srv.StopChan()
+	go func() {
+		defer signal.Stop(sigs)
+		select {
+		case <-sigs:
+			srv.Stop(srv.Timeout)
+		case <-stopped:
+		}
+	}()
+}
+
 // Serve is a convenience function that runs the vermouth stack as an HTTP
-// server. The addr string takes the same format as http.ListenAndServe.
+// server. The addr string takes the same format as http.ListenAndServe, or
+// one of the Unix socket formats accepted by Listen.
 func (vm *Vermouth) Serve(addr string) error {
-	srv := vm.NewServer()
-	srv.Addr = addr
-	vm.ObserveContext(srv)
-	return srv.ListenAndServe()
+	return vm.ServeAddrs(addr)
 }
 
 // ServeListener is like Serve, but runs vermouth on top of an arbitrary net.Listener.
 func (vm *Vermouth) ServeListener(l net.Listener) error {
-	srv := vm.NewServer()
-	vm.ObserveContext(srv)
-	return srv.Serve(l)
+	return vm.ServeAll(l)
+}
+
+// ServeAddrs listens on every address and serves them with ServeAll.
+// Addresses take the formats accepted by Listen, so Unix domain sockets can
+// be served with "unix:///run/app.sock".
+func (vm *Vermouth) ServeAddrs(addrs ...string) error {
+	listeners := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		l, err := vm.listen(addr)
+		if err != nil {
+			closeListeners(listeners)
+			return err
+		}
+		listeners = append(listeners, l)
+	}
+	return vm.serveAll(listeners, addrs, nil)
+}
+
+// ServeAll runs one server per listener, all sharing the same middleware
+// stack, until the vermouth context is done or one of the servers stops.
+// Every server is then shut down gracefully, and the first error of a server
+// is returned.
+//
+// Start hooks run before the first connection is accepted, and shutdown and
+// stopped hooks run after every server has stopped. Their errors are returned
+// together with the error of the servers.
+//
+// When run by systemd with NOTIFY_SOCKET set, readiness is notified once the
+// start hooks have run, and stopping when the shutdown begins.
+func (vm *Vermouth) ServeAll(listeners ...net.Listener) error {
+	names := make([]string, len(listeners))
+	for i, l := range listeners {
+		names[i] = l.Addr().Network() + "://" + l.Addr().String()
+	}
+	return vm.serveAll(listeners, names, nil)
+}
+
+// serveAll implements ServeAll. names are the addresses the listeners were
+// created for, under which they are passed on by Upgrade. If tlsConfig is
+// not nil, the servers accept TLS connections.
+func (vm *Vermouth) serveAll(listeners []net.Listener, names []string, tlsConfig *tls.Config) error {
+	if len(listeners) == 0 {
+		return errors.New("vermouth: no listeners to serve")
+	}
+	serveListeners, err := vm.proxyListeners(listeners)
+	if err != nil {
+		closeListeners(listeners)
+		return err
+	}
+	if err := vm.runStartHooks(); err != nil {
+		closeListeners(listeners)
+		return err
+	}
+
+	handler := vm.compile()
+	servers := make([]*Server, len(listeners))
+	errc := make(chan error, len(listeners))
+	var initiated sync.Once
+	for i, l := range serveListeners {
+		srv := vm.NewServer()
+		srv.Handler = handler
+		// every listener has its own server, but shutdown is initiated once
+		if hook := srv.ShutdownInitiated; hook != nil {
+			srv.ShutdownInitiated = func() { initiated.Do(hook) }
+		}
+		servers[i] = srv
+		go func(l net.Listener) {
+			if tlsConfig != nil {
+				srv.TLSConfig = tlsConfig
+				errc <- srv.ServeTLS(l, "", "")
+			} else {
+				errc <- srv.Serve(l)
+			}
+		}(l)
+	}
+
+	ctx, cancel := context.WithCancel(vm.ctx)
+	defer cancel()
+	vm.serving.set(listeners, names, cancel)
+	defer vm.serving.set(nil, nil, nil)
+	if vm.Options != nil && vm.Options.HotRestart {
+		vm.handleUpgradeSignals(ctx)
+	}
+	notifyReady()
+
+	go func() {
+		<-ctx.Done()
+		SdNotify("STOPPING=1")
+		for _, srv := range servers {
+			srv.Stop(srv.Timeout)
+		}
+	}()
+
+	var first error
+	for range servers {
+		if err := <-errc; err != nil && first == nil {
+			first = err
+		}
+		// a server which stops for any reason takes the others down
+		cancel()
+	}
+	return vm.runStopHooks(servers[0], first)
+}
+
+// proxyListeners wraps the listeners with ProxyListener if
+// Options.ProxyProtocol is set.
+func (vm *Vermouth) proxyListeners(listeners []net.Listener) ([]net.Listener, error) {
+	opts := vm.Options
+	if opts == nil || !opts.ProxyProtocol {
+		return listeners, nil
+	}
+	if len(opts.ProxyProtocolTrusted) == 0 {
+		return nil, errors.New("vermouth: ProxyProtocol requires ProxyProtocolTrusted")
+	}
+	trusted, err := parseCIDRs(opts.ProxyProtocolTrusted)
+	if err != nil {
+		return nil, err
+	}
+	wrapped := make([]net.Listener, len(listeners))
+	for i, l := range listeners {
+		wrapped[i] = &ProxyListener{Listener: l, Trusted: trusted, Timeout: opts.ProxyProtocolTimeout}
+	}
+	return wrapped, nil
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, l := range listeners {
+		l.Close()
+	}
 }
 
 // ObserveContext observe the status for top level context object.
 // If context is done, shutdown a server gracefully.
-func (vm *Vermouth) ObserveContext(srv *graceful.Server) {
+func (vm *Vermouth) ObserveContext(srv *Server) {
 	go func() {
 		select {
 		case <-vm.ctx.Done():
@@ -33,3 +363,50 @@ func (vm *Vermouth) ObserveContext(srv *graceful.Server) {
 		}
 	}()
 }
+
+// limitListener accepts at most n simultaneous connections.
+type limitListener struct {
+	net.Listener
+	sem  chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+func newLimitListener(l net.Listener, n int) net.Listener {
+	return &limitListener{
+		Listener: l,
+		sem:      make(chan struct{}, n),
+		done:     make(chan struct{}),
+	}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case l.sem <- struct{}{}:
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+	c, err := l.Listener.Accept()
+	if err != nil {
+		<-l.sem
+		return nil, err
+	}
+	return &limitConn{Conn: c, release: func() { <-l.sem }}, nil
+}
+
+func (l *limitListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
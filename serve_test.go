@@ -0,0 +1,207 @@
+package vermouth
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func serveTestApp(t *testing.T, ctx context.Context, handler http.HandlerFunc, configure func(*Options)) (string, <-chan error) {
+	vm := New().WithContext(ctx)
+	vm.Get("/", handler)
+	if configure != nil {
+		configure(vm.Options)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- vm.ServeListener(l) }()
+	return "http://" + l.Addr().String() + "/", errc
+}
+
+func TestServeGracefulShutdownFinishesInflightRequests(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var shutdownInitiated int32
+	url, errc := serveTestApp(t, ctx, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	}, func(o *Options) {
+		o.GracefulTimeout = 5 * time.Second
+		o.ShutdownInitiated = func() { atomic.StoreInt32(&shutdownInitiated, 1) }
+	})
+
+	respc := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			respc <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		respc <- string(body)
+	}()
+
+	<-started
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case err := <-errc:
+		t.Fatalf("Serve returned before the request finished: %v", err)
+	default:
+	}
+	expect(t, atomic.LoadInt32(&shutdownInitiated), int32(1))
+
+	close(release)
+	expect(t, <-respc, "done")
+	select {
+	case err := <-errc:
+		expect(t, err, nil)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after shutdown")
+	}
+}
+
+func TestServeGracefulTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	url, errc := serveTestApp(t, ctx, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}, func(o *Options) {
+		o.GracefulTimeout = 50 * time.Millisecond
+	})
+
+	go http.Get(url)
+	<-started
+	cancel()
+	select {
+	case err := <-errc:
+		expect(t, err, context.DeadlineExceeded)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after the graceful timeout")
+	}
+}
+
+func TestServeListenLimitAndConnState(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var active, maxActive, states int32
+	url, _ := serveTestApp(t, ctx, func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&active, 1)
+		for {
+			m := atomic.LoadInt32(&maxActive)
+			if n <= m || atomic.CompareAndSwapInt32(&maxActive, m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&active, -1)
+	}, func(o *Options) {
+		o.ListenLimit = 1
+		o.ConnState = func(net.Conn, http.ConnState) { atomic.AddInt32(&states, 1) }
+	})
+
+	done := make(chan struct{})
+	for i := 0; i < 3; i++ {
+		go func() {
+			client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+			if resp, err := client.Get(url); err == nil {
+				resp.Body.Close()
+			}
+			done <- struct{}{}
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		<-done
+	}
+	expect(t, atomic.LoadInt32(&maxActive), int32(1))
+	refute(t, atomic.LoadInt32(&states), int32(0))
+}
+
+func TestServeAll(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	vm := New().WithContext(ctx)
+	vm.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	var shutdownInitiated int32
+	vm.Options.ShutdownInitiated = func() { atomic.AddInt32(&shutdownInitiated, 1) }
+
+	var listeners []net.Listener
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners = append(listeners, l)
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- vm.ServeAll(listeners...) }()
+
+	for _, l := range listeners {
+		resp, err := http.Get("http://" + l.Addr().String() + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		expect(t, string(body), "hello")
+	}
+
+	cancel()
+	select {
+	case err := <-errc:
+		expect(t, err, nil)
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeAll did not return after the context was cancelled")
+	}
+	// the hooks of http.Server run in the background
+	time.Sleep(50 * time.Millisecond)
+	expect(t, atomic.LoadInt32(&shutdownInitiated), int32(1))
+}
+
+type failingListener struct {
+	net.Listener
+	err error
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	return nil, l.err
+}
+
+func TestServeAllStopsOthersOnFatalError(t *testing.T) {
+	vm := New()
+	good, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fatal := &net.OpError{Op: "accept", Err: errors.New("listener broken")}
+
+	errc := make(chan error, 1)
+	go func() { errc <- vm.ServeAll(good, &failingListener{bad, fatal}) }()
+	select {
+	case err := <-errc:
+		expect(t, err, error(fatal))
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeAll did not return after a fatal error")
+	}
+	_, err = net.Dial("tcp", good.Addr().String())
+	refute(t, err, nil)
+}
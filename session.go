@@ -0,0 +1,456 @@
+package vermouth
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SessionCtxKey is a key to be used when Session object is bound to context object.
+var SessionCtxKey = "vermouth.Session"
+
+// Errors returned while decoding a session cookie.
+var (
+	ErrSessionInvalid = errors.New("vermouth: session cookie is invalid")
+	ErrSessionExpired = errors.New("vermouth: session cookie is expired")
+)
+
+const flashKey = "_flash"
+
+// Session holds the values of a client session.
+// Values must be registered with gob.Register when they are stored in a
+// cookie or in a store which serializes them.
+type Session struct {
+	ID     string
+	Values map[string]interface{}
+	// IsNew reports whether the session was created by this request.
+	IsNew bool
+
+	mu        sync.Mutex
+	oldID     string
+	modified  bool
+	destroyed bool
+}
+
+func newSession() *Session {
+	return &Session{
+		ID:     newSessionID(),
+		Values: make(map[string]interface{}),
+		IsNew:  true,
+	}
+}
+
+// GetSession returns the Session bound to ctx, or nil.
+func GetSession(ctx context.Context) *Session {
+	s, _ := ctx.Value(SessionCtxKey).(*Session)
+	return s
+}
+
+// NewSessionContext returns a copy of ctx which carries the session.
+func NewSessionContext(ctx context.Context, s *Session) context.Context {
+	return context.WithValue(ctx, SessionCtxKey, s)
+}
+
+// Get returns the value stored under key.
+func (s *Session) Get(key string) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Values[key]
+}
+
+// Set stores value under key.
+func (s *Session) Set(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Values[key] = value
+	s.modified = true
+}
+
+// Delete removes the value stored under key.
+func (s *Session) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.Values[key]; ok {
+		delete(s.Values, key)
+		s.modified = true
+	}
+}
+
+// AddFlash adds a message which is returned once by Flashes.
+func (s *Session) AddFlash(value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	flashes, _ := s.Values[flashKey].([]interface{})
+	s.Values[flashKey] = append(flashes, value)
+	s.modified = true
+}
+
+// Flashes returns and clears the flash messages.
+func (s *Session) Flashes() []interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	flashes, _ := s.Values[flashKey].([]interface{})
+	if flashes != nil {
+		delete(s.Values, flashKey)
+		s.modified = true
+	}
+	return flashes
+}
+
+// Regenerate assigns a new session ID while keeping the values.
+// It should be called when the privilege level changes, e.g. on login,
+// to prevent session fixation.
+func (s *Session) Regenerate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.oldID == "" && !s.IsNew {
+		s.oldID = s.ID
+	}
+	s.ID = newSessionID()
+	s.modified = true
+}
+
+// Destroy clears the values and expires the session cookie.
+func (s *Session) Destroy() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Values = make(map[string]interface{})
+	s.destroyed = true
+	s.modified = true
+}
+
+// SessionStore is a server-side storage of session values.
+type SessionStore interface {
+	// Load returns the values of the session id.
+	// A missing or expired session is reported with a nil map.
+	Load(ctx context.Context, id string) (map[string]interface{}, error)
+	// Save stores the values of the session id for maxAge. A non-positive
+	// maxAge stores them without expiry, until Delete is called.
+	Save(ctx context.Context, id string, values map[string]interface{}, maxAge time.Duration) error
+	// Delete removes the session id.
+	Delete(ctx context.Context, id string) error
+}
+
+type memoryEntry struct {
+	values  map[string]interface{}
+	expires time.Time
+}
+
+// expired reports whether the entry has expired at now. Entries without an
+// expiry time never do.
+func (e memoryEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && now.After(e.expires)
+}
+
+// MemoryStore is a SessionStore which keeps sessions in process memory.
+type MemoryStore struct {
+	mu       sync.Mutex
+	sessions map[string]memoryEntry
+}
+
+// NewMemoryStore returns a new empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{sessions: make(map[string]memoryEntry)}
+}
+
+// Load implements SessionStore.
+func (m *MemoryStore) Load(ctx context.Context, id string) (map[string]interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.sessions[id]
+	if !ok {
+		return nil, nil
+	}
+	if e.expired(time.Now()) {
+		delete(m.sessions, id)
+		return nil, nil
+	}
+	return copyValues(e.values), nil
+}
+
+// Save implements SessionStore.
+func (m *MemoryStore) Save(ctx context.Context, id string, values map[string]interface{}, maxAge time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e := memoryEntry{values: copyValues(values)}
+	if maxAge > 0 {
+		e.expires = time.Now().Add(maxAge)
+	}
+	m.sessions[id] = e
+	return nil
+}
+
+// Delete implements SessionStore.
+func (m *MemoryStore) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, id)
+	return nil
+}
+
+// GC removes expired sessions.
+func (m *MemoryStore) GC() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for id, e := range m.sessions {
+		if e.expired(now) {
+			delete(m.sessions, id)
+		}
+	}
+}
+
+// SessionCodec encrypts and authenticates cookie values with AES-GCM.
+// The first key is used for encoding, and every key is tried for decoding,
+// so keys can be rotated by prepending a new one.
+type SessionCodec struct {
+	aeads []cipher.AEAD
+}
+
+// NewSessionCodec returns a SessionCodec for keys of 16, 24 or 32 bytes.
+func NewSessionCodec(keys ...[]byte) (*SessionCodec, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("vermouth: at least one session key is required")
+	}
+	c := &SessionCodec{}
+	for _, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		c.aeads = append(c.aeads, aead)
+	}
+	return c, nil
+}
+
+// Encode encrypts data for the cookie name.
+// The cookie name is authenticated so values cannot be swapped between cookies.
+func (c *SessionCodec) Encode(name string, data []byte) (string, error) {
+	aead := c.aeads[0]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	plain := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint64(plain, uint64(time.Now().Unix()))
+	copy(plain[8:], data)
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, plain, []byte(name))), nil
+}
+
+// Decode decrypts a value produced by Encode for the cookie name.
+// Values older than maxAge are rejected when maxAge is positive.
+func (c *SessionCodec) Decode(name, value string, maxAge time.Duration) ([]byte, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, ErrSessionInvalid
+	}
+	for _, aead := range c.aeads {
+		if len(raw) < aead.NonceSize() {
+			continue
+		}
+		plain, err := aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], []byte(name))
+		if err != nil || len(plain) < 8 {
+			continue
+		}
+		issued := time.Unix(int64(binary.BigEndian.Uint64(plain)), 0)
+		if maxAge > 0 && time.Since(issued) > maxAge {
+			return nil, ErrSessionExpired
+		}
+		return plain[8:], nil
+	}
+	return nil, ErrSessionInvalid
+}
+
+// Sessions is a middleware which loads the session of a request into the
+// context and saves it before the response headers are written.
+//
+// Without a Store the session values are kept in the cookie itself; with a
+// Store only the session ID is kept in the cookie.
+type Sessions struct {
+	codec *SessionCodec
+
+	// Store keeps session values on the server side. If it is nil, values
+	// are stored in the cookie.
+	Store SessionStore
+
+	// Name and attributes of the session cookie.
+	CookieName string
+	Path       string
+	Domain     string
+	Secure     bool
+	HttpOnly   bool
+	SameSite   http.SameSite
+
+	// MaxAge is the lifetime of the session cookie and of the values in the
+	// Store. If zero, the cookie lasts for the browser session and the
+	// values do not expire in the Store. The lifetime restarts only when a
+	// modified session is saved; it is not extended by reading the session.
+	MaxAge time.Duration
+
+	// ErrorLog specifies an optional logger for errors saving sessions.
+	// If nil, logging goes to os.Stderr via the log package's standard logger.
+	ErrorLog *log.Logger
+}
+
+// NewSessions returns a new Sessions middleware using codec for the cookie.
+func NewSessions(codec *SessionCodec, store SessionStore) *Sessions {
+	return &Sessions{
+		codec:      codec,
+		Store:      store,
+		CookieName: "session",
+		Path:       "/",
+		MaxAge:     7 * 24 * time.Hour,
+		HttpOnly:   true,
+		SameSite:   http.SameSiteLaxMode,
+	}
+}
+
+type sessionCookie struct {
+	ID     string
+	Values map[string]interface{}
+}
+
+func (m *Sessions) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	rw, ok := w.(ResponseWriter)
+	if !ok {
+		rw = NewResponseWriter(w)
+	}
+	s := m.load(r)
+
+	var once sync.Once
+	save := func() {
+		once.Do(func() {
+			if err := m.save(rw, r, s); err != nil {
+				m.logf("vermouth: saving session: %v", err)
+			}
+		})
+	}
+	rw.Before(func(ResponseWriter) { save() })
+	next(rw, r.WithContext(NewSessionContext(r.Context(), s)))
+	save()
+}
+
+func (m *Sessions) load(r *http.Request) *Session {
+	cookie, err := r.Cookie(m.CookieName)
+	if err != nil {
+		return newSession()
+	}
+	data, err := m.codec.Decode(m.CookieName, cookie.Value, m.MaxAge)
+	if err != nil {
+		return newSession()
+	}
+	var sc sessionCookie
+	if m.Store != nil {
+		sc.ID = string(data)
+		sc.Values, err = m.Store.Load(r.Context(), sc.ID)
+		if err != nil {
+			m.logf("vermouth: loading session: %v", err)
+		}
+		if sc.Values == nil {
+			return newSession()
+		}
+	} else if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&sc); err != nil {
+		return newSession()
+	}
+	if sc.Values == nil {
+		sc.Values = make(map[string]interface{})
+	}
+	return &Session{ID: sc.ID, Values: sc.Values}
+}
+
+func (m *Sessions) save(w http.ResponseWriter, r *http.Request, s *Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.modified {
+		return nil
+	}
+	if s.destroyed {
+		if m.Store != nil && !s.IsNew {
+			if err := m.Store.Delete(r.Context(), s.ID); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, m.cookie("", -1))
+		return nil
+	}
+	if m.Store != nil && s.oldID != "" {
+		if err := m.Store.Delete(r.Context(), s.oldID); err != nil {
+			return err
+		}
+	}
+
+	var data []byte
+	if m.Store != nil {
+		if err := m.Store.Save(r.Context(), s.ID, s.Values, m.MaxAge); err != nil {
+			return err
+		}
+		data = []byte(s.ID)
+	} else {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(sessionCookie{ID: s.ID, Values: s.Values}); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+	}
+	value, err := m.codec.Encode(m.CookieName, data)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, m.cookie(value, int(m.MaxAge/time.Second)))
+	return nil
+}
+
+func (m *Sessions) cookie(value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     m.CookieName,
+		Value:    value,
+		Path:     m.Path,
+		Domain:   m.Domain,
+		MaxAge:   maxAge,
+		Secure:   m.Secure,
+		HttpOnly: m.HttpOnly,
+		SameSite: m.SameSite,
+	}
+}
+
+func (m *Sessions) logf(format string, args ...interface{}) {
+	if m.ErrorLog != nil {
+		m.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+func newSessionID() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func copyValues(values map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		c[k] = v
+	}
+	return c
+}
+
+func init() {
+	gob.Register([]interface{}{})
+}
@@ -0,0 +1,132 @@
+package vermouth
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newSessionApp(t *testing.T, store SessionStore) *Vermouth {
+	codec, err := NewSessionCodec([]byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := New()
+	vm.Use("/", NewSessions(codec, store))
+	vm.Get("/login", func(w http.ResponseWriter, r *http.Request) {
+		s := GetSession(r.Context())
+		s.Regenerate()
+		s.Set("user", "alice")
+		s.AddFlash("welcome")
+		w.WriteHeader(http.StatusOK)
+	})
+	vm.Get("/me", func(w http.ResponseWriter, r *http.Request) {
+		s := GetSession(r.Context())
+		flashes := s.Flashes()
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "%v %v", s.Get("user"), flashes)
+	})
+	vm.Get("/logout", func(w http.ResponseWriter, r *http.Request) {
+		GetSession(r.Context()).Destroy()
+		w.WriteHeader(http.StatusOK)
+	})
+	return vm
+}
+
+func sessionRequest(vm *Vermouth, path string, cookie *http.Cookie) (*httptest.ResponseRecorder, *http.Cookie) {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", path, nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	vm.ServeHTTP(rec, req)
+	for _, c := range rec.Result().Cookies() {
+		return rec, c
+	}
+	return rec, nil
+}
+
+func TestSessions(t *testing.T) {
+	for name, store := range map[string]SessionStore{"cookie": nil, "memory": NewMemoryStore()} {
+		vm := newSessionApp(t, store)
+
+		rec, cookie := sessionRequest(vm, "/me", nil)
+		expect(t, rec.Body.String(), "<nil> []")
+		if cookie != nil {
+			t.Errorf("%s: unmodified session should not set a cookie", name)
+		}
+
+		_, cookie = sessionRequest(vm, "/login", nil)
+		if cookie == nil {
+			t.Fatalf("%s: login did not set a cookie", name)
+		}
+
+		rec, updated := sessionRequest(vm, "/me", cookie)
+		expect(t, rec.Body.String(), "alice [welcome]")
+		if updated != nil {
+			cookie = updated
+		}
+		rec, _ = sessionRequest(vm, "/me", cookie)
+		expect(t, rec.Body.String(), "alice []")
+
+		_, cleared := sessionRequest(vm, "/logout", cookie)
+		expect(t, cleared.MaxAge, -1)
+	}
+}
+
+func TestSessionRegenerateDeletesOldID(t *testing.T) {
+	store := NewMemoryStore()
+	vm := newSessionApp(t, store)
+
+	_, first := sessionRequest(vm, "/login", nil)
+	_, second := sessionRequest(vm, "/login", first)
+	refute(t, first.Value, second.Value)
+	expect(t, len(store.sessions), 1)
+}
+
+func TestSessionStoreWithoutMaxAge(t *testing.T) {
+	codec, _ := NewSessionCodec([]byte("0123456789abcdef0123456789abcdef"))
+	store := NewMemoryStore()
+	sessions := NewSessions(codec, store)
+	sessions.MaxAge = 0
+	vm := New()
+	vm.Use("/", sessions)
+	vm.Get("/login", func(w http.ResponseWriter, r *http.Request) {
+		GetSession(r.Context()).Set("user", "alice")
+	})
+	vm.Get("/me", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, GetSession(r.Context()).Get("user"))
+	})
+
+	_, cookie := sessionRequest(vm, "/login", nil)
+	expect(t, cookie.MaxAge, 0)
+	time.Sleep(10 * time.Millisecond)
+	rec, _ := sessionRequest(vm, "/me", cookie)
+	expect(t, rec.Body.String(), "alice")
+	store.GC()
+	expect(t, len(store.sessions), 1)
+}
+
+func TestSessionCodecKeyRotation(t *testing.T) {
+	oldKey := []byte("0123456789abcdef")
+	newKey := []byte("fedcba9876543210")
+	old, _ := NewSessionCodec(oldKey)
+	rotated, _ := NewSessionCodec(newKey, oldKey)
+
+	value, err := old.Encode("session", []byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := rotated.Decode("session", value, time.Hour)
+	expect(t, err, nil)
+	expect(t, string(data), "payload")
+
+	_, err = rotated.Decode("other", value, time.Hour)
+	expect(t, err, ErrSessionInvalid)
+
+	value, _ = rotated.Encode("session", []byte("payload"))
+	_, err = old.Decode("session", value, time.Hour)
+	expect(t, err, ErrSessionInvalid)
+}
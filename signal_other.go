@@ -0,0 +1,9 @@
+//go:build windows || plan9
+
+package vermouth
+
+import "os"
+
+// upgradeSignals is empty: there is no SIGUSR2 on this platform, so Upgrade
+// can only be called directly.
+var upgradeSignals []os.Signal
@@ -0,0 +1,11 @@
+//go:build !windows && !plan9
+
+package vermouth
+
+import (
+	"os"
+	"syscall"
+)
+
+// upgradeSignals trigger Upgrade when Options.HotRestart is set.
+var upgradeSignals = []os.Signal{syscall.SIGUSR2}
@@ -0,0 +1,321 @@
+package vermouth
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrStreamClosed is returned when sending to a closed EventStream.
+var ErrStreamClosed = errors.New("vermouth: event stream closed")
+
+// DefaultHeartbeat is the Heartbeat of new EventStreams.
+var DefaultHeartbeat = 15 * time.Second
+
+// Event is a server-sent event.
+type Event struct {
+	ID    string
+	Event string
+	Data  string
+}
+
+// EventStream sends server-sent events (text/event-stream) to a client.
+//
+// The stream is opened by the first Send, or by Open, after which the fields
+// must not be changed. It is closed when the request context is done, e.g.
+// on graceful shutdown, when the client disconnects or the handler returns,
+// or by Close. Handlers
+// typically send events until Done is closed:
+//
+//	sse := vermouth.NewEventStream(w, r)
+//	for {
+//		select {
+//		case msg := <-updates:
+//			if err := sse.Send("update", "", msg); err != nil {
+//				return
+//			}
+//		case <-sse.Done():
+//			return
+//		}
+//	}
+type EventStream struct {
+	// Heartbeat is the interval of comments sent to keep the connection
+	// alive through proxies. If it is not positive, none are sent.
+	Heartbeat time.Duration
+
+	// Retry is sent as the reconnection time of the client, if positive.
+	Retry time.Duration
+
+	// Buffer, if set, replays the events after the Last-Event-ID of a
+	// reconnecting client when the stream is opened. Sent events are not
+	// added to it, since it is typically shared by several streams: add
+	// each event to the Buffer once and send the Event returned by Add,
+	// which carries the ID the client reconnects with.
+	Buffer *EventBuffer
+
+	w       http.ResponseWriter
+	r       *http.Request
+	rc      *http.ResponseController
+	mu      sync.Mutex
+	opened  bool
+	err     error
+	done    chan struct{}
+	closing sync.Once
+}
+
+// NewEventStream returns an EventStream for the request.
+func NewEventStream(w http.ResponseWriter, r *http.Request) *EventStream {
+	return &EventStream{
+		Heartbeat: DefaultHeartbeat,
+		w:         w,
+		r:         r,
+		rc:        http.NewResponseController(w),
+		done:      make(chan struct{}),
+	}
+}
+
+// LastEventID returns the ID of the last event a reconnecting client received.
+func (s *EventStream) LastEventID() string {
+	return s.r.Header.Get("Last-Event-ID")
+}
+
+// Done returns a channel which is closed when the stream is closed.
+func (s *EventStream) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close closes the stream and stops the heartbeat. Streams on a vermouth
+// ResponseWriter are closed when the middleware stack returns; otherwise the
+// handler must call Close before it returns.
+func (s *EventStream) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.close()
+}
+
+func (s *EventStream) close() {
+	s.closing.Do(func() { close(s.done) })
+}
+
+// Open writes the response header, the retry hint and the replayed events.
+// It returns an error if the response cannot be flushed.
+func (s *EventStream) Open() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.open()
+}
+
+func (s *EventStream) open() error {
+	if s.opened {
+		return s.err
+	}
+	s.opened = true
+
+	h := s.w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no")
+	h.Del("Content-Length")
+	s.w.WriteHeader(http.StatusOK)
+
+	var b strings.Builder
+	if s.Retry > 0 {
+		b.WriteString("retry: " + strconv.FormatInt(int64(s.Retry/time.Millisecond), 10) + "\n\n")
+	}
+	if s.Buffer != nil {
+		for _, ev := range s.Buffer.Since(s.LastEventID()) {
+			writeEvent(&b, ev)
+		}
+	}
+	if err := s.write(b.String()); err != nil {
+		return err
+	}
+	if rw, ok := s.w.(ResponseWriter); ok {
+		rw.After(func(ResponseWriter) { s.Close() })
+	}
+	var closed <-chan bool
+	if cn, ok := s.w.(http.CloseNotifier); ok {
+		closed = cn.CloseNotify()
+	}
+	go s.watch(closed)
+	return nil
+}
+
+// watch sends heartbeats and closes the stream when the request is done or
+// the client disconnects.
+func (s *EventStream) watch(closed <-chan bool) {
+	disconnected := requestContext(s.r).Done()
+	var tick <-chan time.Time
+	if s.Heartbeat > 0 {
+		ticker := time.NewTicker(s.Heartbeat)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-tick:
+			if s.Comment("heartbeat") != nil {
+				return
+			}
+		case <-closed:
+			s.Close()
+			return
+		case <-s.r.Context().Done():
+			s.Close()
+			return
+		case <-disconnected:
+			s.Close()
+			return
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Send sends an event. event and id may be empty; multi-line data is sent
+// as several data fields.
+func (s *EventStream) Send(event, id, data string) error {
+	return s.SendEvent(Event{ID: id, Event: event, Data: data})
+}
+
+// SendEvent sends ev.
+func (s *EventStream) SendEvent(ev Event) error {
+	var b strings.Builder
+	writeEvent(&b, ev)
+	return s.send(b.String())
+}
+
+// Comment sends a comment, which clients ignore.
+func (s *EventStream) Comment(text string) error {
+	var b strings.Builder
+	for _, line := range splitLines(text) {
+		b.WriteString(": " + line + "\n")
+	}
+	b.WriteString("\n")
+	return s.send(b.String())
+}
+
+func (s *EventStream) send(msg string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.open(); err != nil {
+		return err
+	}
+	select {
+	case <-s.done:
+		return ErrStreamClosed
+	default:
+	}
+	return s.write(msg)
+}
+
+// final sends ev on an open stream even after it was closed because the
+// request is done, so that clients can be told why the stream ends.
+func (s *EventStream) final(ev Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.opened {
+		return ErrStreamClosed
+	}
+	var b strings.Builder
+	writeEvent(&b, ev)
+	return s.write(b.String())
+}
+
+// write writes and flushes msg. Errors close the stream.
+func (s *EventStream) write(msg string) error {
+	if s.err != nil {
+		return s.err
+	}
+	_, err := s.w.Write([]byte(msg))
+	if err == nil {
+		err = s.rc.Flush()
+	}
+	if err != nil {
+		s.err = err
+		s.close()
+	}
+	return err
+}
+
+func writeEvent(b *strings.Builder, ev Event) {
+	if ev.Event != "" {
+		b.WriteString("event: " + stripLineBreaks(ev.Event) + "\n")
+	}
+	if ev.ID != "" {
+		b.WriteString("id: " + stripLineBreaks(strings.Replace(ev.ID, "\x00", "", -1)) + "\n")
+	}
+	for _, line := range splitLines(ev.Data) {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+}
+
+func splitLines(s string) []string {
+	s = strings.Replace(s, "\r\n", "\n", -1)
+	return strings.Split(strings.Replace(s, "\r", "\n", -1), "\n")
+}
+
+func stripLineBreaks(s string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(s)
+}
+
+// EventBuffer keeps the latest events of a stream, so that they can be
+// replayed to reconnecting clients. It is safe for concurrent use and is
+// typically shared by every EventStream of a topic.
+type EventBuffer struct {
+	mu     sync.Mutex
+	events []Event
+	next   int
+	full   bool
+	seq    uint64
+}
+
+// NewEventBuffer returns an EventBuffer holding the latest size events.
+func NewEventBuffer(size int) *EventBuffer {
+	if size < 1 {
+		size = 1
+	}
+	return &EventBuffer{events: make([]Event, size)}
+}
+
+// Add stores ev, assigning a sequential ID if it has none, and returns it.
+func (b *EventBuffer) Add(ev Event) Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	if ev.ID == "" {
+		ev.ID = strconv.FormatUint(b.seq, 10)
+	}
+	b.events[b.next] = ev
+	b.next = (b.next + 1) % len(b.events)
+	if b.next == 0 {
+		b.full = true
+	}
+	return ev
+}
+
+// Since returns the events stored after the event with the given ID. If id
+// is empty nothing is returned, and if it is no longer buffered every stored
+// event is returned.
+func (b *EventBuffer) Since(id string) []Event {
+	if id == "" {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var events []Event
+	if b.full {
+		events = append(events, b.events[b.next:]...)
+	}
+	events = append(events, b.events[:b.next]...)
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].ID == id {
+			return events[i+1:]
+		}
+	}
+	return events
+}
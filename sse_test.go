@@ -0,0 +1,215 @@
+package vermouth
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readEvents reads n blank line terminated blocks from the stream.
+func readEvents(t *testing.T, r *bufio.Reader, n int) []string {
+	var blocks []string
+	var block strings.Builder
+	for len(blocks) < n {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading stream: %v (got %q)", err, blocks)
+		}
+		if line == "\n" {
+			blocks = append(blocks, block.String())
+			block.Reset()
+			continue
+		}
+		block.WriteString(line)
+	}
+	return blocks
+}
+
+func TestEventStreamSend(t *testing.T) {
+	vm := New()
+	vm.Get("/events", func(w http.ResponseWriter, r *http.Request) {
+		sse := NewEventStream(w, r)
+		sse.Retry = 3 * time.Second
+		sse.Send("greeting", "1", "hello")
+		sse.Send("", "", "line one\nline two")
+		sse.SendEvent(Event{ID: "bad\nid", Event: "x\r\ny", Data: ""})
+	})
+	ts := httptest.NewServer(vm)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	expect(t, resp.Header.Get("Content-Type"), "text/event-stream")
+	expect(t, resp.Header.Get("Cache-Control"), "no-cache")
+
+	events := readEvents(t, bufio.NewReader(resp.Body), 4)
+	expect(t, events[0], "retry: 3000\n")
+	expect(t, events[1], "event: greeting\nid: 1\ndata: hello\n")
+	expect(t, events[2], "data: line one\ndata: line two\n")
+	expect(t, events[3], "event: xy\nid: badid\ndata: \n")
+}
+
+func TestEventStreamHeartbeat(t *testing.T) {
+	vm := New()
+	vm.Get("/events", func(w http.ResponseWriter, r *http.Request) {
+		sse := NewEventStream(w, r)
+		sse.Heartbeat = 10 * time.Millisecond
+		sse.Open()
+		select {
+		case <-sse.Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+	ts := httptest.NewServer(vm)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := readEvents(t, bufio.NewReader(resp.Body), 2)
+	expect(t, events[0], ": heartbeat\n")
+	expect(t, events[1], ": heartbeat\n")
+	resp.Body.Close()
+}
+
+func TestEventStreamClosesOnClientDisconnect(t *testing.T) {
+	closed := make(chan struct{})
+	vm := New()
+	vm.Get("/events", func(w http.ResponseWriter, r *http.Request) {
+		sse := NewEventStream(w, r)
+		sse.Heartbeat = 0
+		sse.Send("", "", "first")
+		<-sse.Done()
+		expect(t, sse.Send("", "", "late"), ErrStreamClosed)
+		close(closed)
+	})
+	ts := httptest.NewServer(vm)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readEvents(t, bufio.NewReader(resp.Body), 1)
+	resp.Body.Close()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream was not closed after the client disconnected")
+	}
+}
+
+// unwrapOnlyWriter hides the optional interfaces of a ResponseWriter, except to
+// http.ResponseController.
+type unwrapOnlyWriter struct {
+	http.ResponseWriter
+}
+
+func (w unwrapOnlyWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func TestEventStreamClosesOnClientDisconnectWithoutCloseNotifier(t *testing.T) {
+	closed := make(chan struct{})
+	vm := New()
+	vm.Get("/events", func(w http.ResponseWriter, r *http.Request) {
+		sse := NewEventStream(unwrapOnlyWriter{w}, r)
+		sse.Heartbeat = 0
+		sse.Send("", "", "first")
+		<-sse.Done()
+		close(closed)
+	})
+	ts := httptest.NewServer(vm)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readEvents(t, bufio.NewReader(resp.Body), 1)
+	resp.Body.Close()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream was not closed after the client disconnected")
+	}
+}
+
+func TestEventStreamClosesOnContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	closed := make(chan struct{})
+	vm := New().WithContext(ctx)
+	vm.Get("/events", func(w http.ResponseWriter, r *http.Request) {
+		sse := NewEventStream(w, r)
+		sse.Open()
+		<-sse.Done()
+		close(closed)
+	})
+	ts := httptest.NewServer(vm)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	cancel()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream was not closed after the context was cancelled")
+	}
+}
+
+func TestEventStreamReplay(t *testing.T) {
+	buf := NewEventBuffer(3)
+	for _, data := range []string{"a", "b", "c", "d"} {
+		buf.Add(Event{Data: data})
+	}
+	vm := New()
+	vm.Get("/events", func(w http.ResponseWriter, r *http.Request) {
+		sse := NewEventStream(w, r)
+		sse.Buffer = buf
+		sse.SendEvent(buf.Add(Event{Data: "live"}))
+	})
+	ts := httptest.NewServer(vm)
+	defer ts.Close()
+
+	req, _ := http.NewRequest("GET", ts.URL+"/events", nil)
+	req.Header.Set("Last-Event-ID", "2")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	events := readEvents(t, bufio.NewReader(resp.Body), 3)
+	expect(t, events[0], "id: 3\ndata: c\n")
+	expect(t, events[1], "id: 4\ndata: d\n")
+	expect(t, events[2], "id: 5\ndata: live\n")
+}
+
+func TestEventBufferSince(t *testing.T) {
+	buf := NewEventBuffer(2)
+	expect(t, len(buf.Since("1")), 0)
+	buf.Add(Event{Data: "a"})
+	buf.Add(Event{ID: "custom", Data: "b"})
+	buf.Add(Event{Data: "c"})
+
+	expect(t, len(buf.Since("")), 0)
+	events := buf.Since("custom")
+	expect(t, len(events), 1)
+	expect(t, events[0].ID, "3")
+	// evicted IDs replay everything still buffered
+	events = buf.Since("1")
+	expect(t, len(events), 2)
+	expect(t, events[0].Data, "b")
+	expect(t, len(buf.Since("3")), 0)
+}
@@ -0,0 +1,287 @@
+package vermouth
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StaticOptions configures Vermouth.Static.
+type StaticOptions struct {
+	// Index is the file served for directories. The default is "index.html".
+	Index string
+
+	// Browse enables directory listings for directories without an index file.
+	Browse bool
+
+	// Precompressed serves "name.br" or "name.gz" instead of name when the
+	// client accepts that encoding and the file exists. The encoding with
+	// the highest q-value in Accept-Encoding is preferred.
+	Precompressed bool
+
+	// MaxAge sets the Cache-Control max-age of ordinary files.
+	MaxAge time.Duration
+
+	// Fingerprinted reports whether a file name contains a content hash, in
+	// which case it is cached for a year as immutable. The default matches
+	// names like "app.3f9a2b1c.js" or "app-3f9a2b1c.js".
+	Fingerprinted func(name string) bool
+
+	// SPA serves the root index file for unknown paths, so that client side
+	// routers can handle them. Paths under SPAExclude are answered with 404;
+	// if it is nil, "/api" is excluded.
+	SPA        bool
+	SPAExclude []string
+}
+
+var fingerprintPattern = regexp.MustCompile(`[.-][0-9a-fA-F]{8,}\.[^.]+$`)
+
+func defaultStaticOptions() *StaticOptions {
+	return &StaticOptions{Index: "index.html"}
+}
+
+// Static serves files from fs under the URL prefix.
+//
+// A "*filepath" route is registered for GET and HEAD below prefix. For the
+// root prefix "/" the files are served from the router's NotFound handler
+// instead, so they do not conflict with other routes.
+func (vm *Vermouth) Static(prefix string, fs http.FileSystem, opts *StaticOptions) *Vermouth {
+	if opts == nil {
+		opts = defaultStaticOptions()
+	} else {
+		copied := *opts
+		opts = &copied
+	}
+	if opts.Index == "" {
+		opts.Index = "index.html"
+	}
+	if opts.Fingerprinted == nil {
+		opts.Fingerprinted = fingerprintPattern.MatchString
+	}
+	if opts.SPAExclude == nil {
+		opts.SPAExclude = []string{"/api"}
+	}
+	prefix = strings.TrimSuffix(prefix, "/")
+	s := &staticHandler{fs: fs, prefix: prefix, opts: opts}
+
+	if prefix == "" {
+		notFound := vm.router.NotFound
+		vm.router.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "GET" || r.Method == "HEAD" {
+				s.serve(w, r, r.URL.Path, notFound)
+				return
+			}
+			if notFound != nil {
+				notFound.ServeHTTP(w, r)
+			} else {
+				http.NotFound(w, r)
+			}
+		})
+		return vm
+	}
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		s.serve(w, r, Path(r.Context()).ByName("filepath"), nil)
+	}
+	vm.Handle("GET", prefix+"/*filepath", handler)
+	vm.Handle("HEAD", prefix+"/*filepath", handler)
+	return vm
+}
+
+type staticHandler struct {
+	fs     http.FileSystem
+	prefix string
+	opts   *StaticOptions
+}
+
+func (s *staticHandler) serve(w http.ResponseWriter, r *http.Request, name string, notFound http.Handler) {
+	name = path.Clean("/" + name)
+
+	f, err := s.fs.Open(name)
+	if err != nil {
+		s.fallback(w, r, notFound)
+		return
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		s.fallback(w, r, notFound)
+		return
+	}
+	if fi.IsDir() {
+		f.Close()
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			target := path.Base(r.URL.Path) + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+		index := path.Join(name, s.opts.Index)
+		if _, err := s.stat(index); err == nil {
+			s.serveFile(w, r, index)
+			return
+		}
+		if s.opts.Browse {
+			s.list(w, r, name)
+			return
+		}
+		s.fallback(w, r, notFound)
+		return
+	}
+	f.Close()
+	s.serveFile(w, r, name)
+}
+
+// fallback answers a request for a missing file.
+func (s *staticHandler) fallback(w http.ResponseWriter, r *http.Request, notFound http.Handler) {
+	if s.opts.SPA && !s.excluded(r.URL.Path) {
+		index := "/" + s.opts.Index
+		if _, err := s.stat(index); err == nil {
+			s.serveFile(w, r, index)
+			return
+		}
+	}
+	if notFound != nil {
+		notFound.ServeHTTP(w, r)
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+func (s *staticHandler) excluded(urlPath string) bool {
+	for _, p := range s.opts.SPAExclude {
+		p = strings.TrimSuffix(p, "/")
+		if urlPath == p || strings.HasPrefix(urlPath, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *staticHandler) serveFile(w http.ResponseWriter, r *http.Request, name string) {
+	h := w.Header()
+	base := path.Base(name)
+	switch {
+	case base == s.opts.Index:
+		h.Set("Cache-Control", "no-cache")
+	case s.opts.Fingerprinted(base):
+		h.Set("Cache-Control", "public, max-age=31536000, immutable")
+	case s.opts.MaxAge > 0:
+		h.Set("Cache-Control", "public, max-age="+strconv.Itoa(int(s.opts.MaxAge/time.Second)))
+	}
+
+	file := name
+	if s.opts.Precompressed {
+		addVary(h, "Accept-Encoding")
+		// the variant with the highest q-value wins, br on a tie
+		var best float64
+		for _, enc := range []struct{ name, ext string }{{"br", ".br"}, {"gzip", ".gz"}} {
+			q := encodingQuality(r, enc.name)
+			if q <= best {
+				continue
+			}
+			if _, err := s.stat(name + enc.ext); err == nil {
+				h.Set("Content-Encoding", enc.name)
+				file, best = name+enc.ext, q
+			}
+		}
+	}
+
+	f, err := s.fs.Open(file)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	// the original name determines the Content-Type of compressed variants
+	http.ServeContent(w, r, name, fi.ModTime(), f)
+}
+
+func (s *staticHandler) stat(name string) (os.FileInfo, error) {
+	f, err := s.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, os.ErrNotExist
+	}
+	return fi, nil
+}
+
+func (s *staticHandler) list(w http.ResponseWriter, r *http.Request, name string) {
+	f, err := s.fs.Open(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	entries, err := f.Readdir(-1)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<pre>\n")
+	for _, e := range entries {
+		n := e.Name()
+		if e.IsDir() {
+			n += "/"
+		}
+		u := url.URL{Path: n}
+		fmt.Fprintf(w, "<a href=\"%s\">%s</a>\n", html.EscapeString(u.String()), html.EscapeString(n))
+	}
+	fmt.Fprintf(w, "</pre>\n")
+}
+
+// encodingQuality returns the q-value of encoding in the Accept-Encoding
+// header of r, falling back to that of "*", or 0 if it is not accepted.
+func encodingQuality(r *http.Request, encoding string) float64 {
+	q, wildcard := -1.0, 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(part, ";")
+		name := strings.TrimSpace(params[0])
+		if name != "*" && !strings.EqualFold(name, encoding) {
+			continue
+		}
+		pq := 1.0
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if v, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					pq = v
+				}
+			}
+		}
+		if name == "*" {
+			wildcard = pq
+		} else {
+			q = pq
+		}
+	}
+	if q < 0 {
+		return wildcard
+	}
+	return q
+}
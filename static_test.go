@@ -0,0 +1,111 @@
+package vermouth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func newStaticFS() http.FileSystem {
+	return http.FS(fstest.MapFS{
+		"index.html":         {Data: []byte("<app>")},
+		"app.3f9a2b1c.js":    {Data: []byte("js")},
+		"app.3f9a2b1c.js.br": {Data: []byte("brotli")},
+		"style.css":          {Data: []byte("css")},
+		"style.css.gz":       {Data: []byte("gzip")},
+		"bundle.js":          {Data: []byte("js")},
+		"bundle.js.br":       {Data: []byte("brotli")},
+		"bundle.js.gz":       {Data: []byte("gzip")},
+		"docs/guide.txt":     {Data: []byte("guide")},
+		"docs/<script>.txt":  {Data: []byte("xss")},
+	})
+}
+
+func staticGet(vm *Vermouth, path, acceptEncoding string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", path, nil)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	vm.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestStatic(t *testing.T) {
+	vm := New()
+	vm.Static("/assets", newStaticFS(), &StaticOptions{Precompressed: true, MaxAge: time.Hour, Browse: true})
+
+	rec := staticGet(vm, "/assets/style.css", "")
+	expect(t, rec.Body.String(), "css")
+	expect(t, rec.Header().Get("Cache-Control"), "public, max-age=3600")
+	expect(t, rec.Header().Get("Vary"), "Accept-Encoding")
+
+	rec = staticGet(vm, "/assets/style.css", "gzip, br")
+	expect(t, rec.Body.String(), "gzip")
+	expect(t, rec.Header().Get("Content-Encoding"), "gzip")
+	expect(t, strings.HasPrefix(rec.Header().Get("Content-Type"), "text/css"), true)
+
+	rec = staticGet(vm, "/assets/app.3f9a2b1c.js", "gzip, br")
+	expect(t, rec.Body.String(), "brotli")
+	expect(t, rec.Header().Get("Cache-Control"), "public, max-age=31536000, immutable")
+
+	rec = staticGet(vm, "/assets/", "")
+	expect(t, rec.Body.String(), "<app>")
+	expect(t, rec.Header().Get("Cache-Control"), "no-cache")
+
+	rec = staticGet(vm, "/assets/docs", "")
+	expect(t, rec.Code, http.StatusMovedPermanently)
+	rec = staticGet(vm, "/assets/docs?page=2", "")
+	expect(t, rec.Header().Get("Location"), "/assets/docs/?page=2")
+	rec = staticGet(vm, "/assets/docs/", "")
+	expect(t, strings.Contains(rec.Body.String(), `<a href="guide.txt">guide.txt</a>`), true)
+	expect(t, strings.Contains(rec.Body.String(), "<script>"), false)
+
+	rec = staticGet(vm, "/assets/../../etc/passwd", "")
+	expect(t, rec.Code, http.StatusNotFound)
+}
+
+func TestStaticPrecompressedQuality(t *testing.T) {
+	vm := New()
+	vm.Static("/assets", newStaticFS(), &StaticOptions{Precompressed: true})
+	for _, tt := range []struct {
+		acceptEncoding, body string
+	}{
+		{"gzip, br", "brotli"},
+		{"gzip;q=1, br;q=0.5", "gzip"},
+		{"br;q=0, gzip;q=0", "js"},
+		{"br;q=0, gzip", "gzip"},
+		{"*", "brotli"},
+		{"gzip;q=0.8, *;q=0.9", "brotli"},
+		{"br;q=0, *", "gzip"},
+		{"*;q=0", "js"},
+		{"identity", "js"},
+	} {
+		rec := staticGet(vm, "/assets/bundle.js", tt.acceptEncoding)
+		expect(t, rec.Body.String(), tt.body)
+	}
+}
+
+func TestStaticSPA(t *testing.T) {
+	vm := New()
+	vm.Get("/api/users", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("users"))
+	})
+	opts := &StaticOptions{SPA: true}
+	vm.Static("/", newStaticFS(), opts)
+	// the caller's options are left untouched
+	expect(t, opts.Index, "")
+	expect(t, opts.SPAExclude == nil, true)
+
+	expect(t, staticGet(vm, "/api/users", "").Body.String(), "users")
+	expect(t, staticGet(vm, "/style.css", "").Body.String(), "css")
+	expect(t, staticGet(vm, "/settings/profile", "").Body.String(), "<app>")
+	expect(t, staticGet(vm, "/api/unknown", "").Code, http.StatusNotFound)
+
+	rec := httptest.NewRecorder()
+	vm.ServeHTTP(rec, httptest.NewRequest("POST", "/settings", nil))
+	expect(t, rec.Code, http.StatusNotFound)
+}
@@ -0,0 +1,110 @@
+package vermouth
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd.
+var listenFdsStart = 3
+
+var (
+	systemdOnce      sync.Once
+	systemdMu        sync.Mutex
+	systemdInherited map[string][]net.Listener
+	systemdErr       error
+)
+
+// SystemdListeners returns the listening sockets passed by systemd socket
+// activation through LISTEN_FDS, LISTEN_PID and LISTEN_FDNAMES, indexed by
+// their FileDescriptorName. Sockets without a name are indexed as "unknown",
+// like systemd does. The environment variables are unset, so the sockets are
+// not inherited by child processes.
+//
+// The sockets are read once; every call returns the listeners which have not
+// been taken by SystemdListener yet.
+func SystemdListeners() (map[string][]net.Listener, error) {
+	systemdOnce.Do(func() {
+		systemdInherited, systemdErr = listenFds(true)
+	})
+	systemdMu.Lock()
+	defer systemdMu.Unlock()
+	ls := make(map[string][]net.Listener, len(systemdInherited))
+	for name, l := range systemdInherited {
+		ls[name] = append([]net.Listener(nil), l...)
+	}
+	return ls, systemdErr
+}
+
+// SystemdListener takes the first socket named name passed by systemd.
+// It is used by Listen for "systemd://name" addresses.
+func SystemdListener(name string) (net.Listener, error) {
+	if _, err := SystemdListeners(); err != nil {
+		return nil, err
+	}
+	systemdMu.Lock()
+	defer systemdMu.Unlock()
+	ls := systemdInherited[name]
+	if len(ls) == 0 {
+		return nil, fmt.Errorf("vermouth: no socket named %q passed by systemd", name)
+	}
+	systemdInherited[name] = ls[1:]
+	return ls[0], nil
+}
+
+// listenFds converts the file descriptors of the socket activation protocol
+// into listeners.
+func listenFds(unsetEnv bool) (map[string][]net.Listener, error) {
+	if unsetEnv {
+		defer func() {
+			os.Unsetenv("LISTEN_PID")
+			os.Unsetenv("LISTEN_FDS")
+			os.Unsetenv("LISTEN_FDNAMES")
+		}()
+	}
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	ls := make(map[string][]net.Listener)
+	for i := 0; i < n; i++ {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(listenFdsStart+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return ls, fmt.Errorf("vermouth: inherited socket %q: %v", name, err)
+		}
+		ls[name] = append(ls[name], l)
+	}
+	return ls, nil
+}
+
+// SdNotify sends a state notification such as "READY=1" to the service
+// manager through NOTIFY_SOCKET. Without NOTIFY_SOCKET it does nothing.
+func SdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,92 @@
+//go:build !windows
+
+package vermouth
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSystemdSocketActivation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vermouth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the socket systemd would pass, and the notification socket it listens on
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := tcp.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// systemd owns a separate descriptor for the socket
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	tcp.Close()
+	notify, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: filepath.Join(dir, "notify"), Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer notify.Close()
+
+	defer func(start int) { listenFdsStart = start }(listenFdsStart)
+	listenFdsStart = fd
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "1")
+	os.Setenv("LISTEN_FDNAMES", "public")
+	os.Setenv("NOTIFY_SOCKET", notify.LocalAddr().String())
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	systemdOnce = sync.Once{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	vm := New().WithContext(ctx)
+	vm.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("activated"))
+	})
+	errc := make(chan error, 1)
+	go func() { errc <- vm.Serve("systemd://public") }()
+
+	buf := make([]byte, 64)
+	notify.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := notify.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, string(buf[:n]), "READY=1")
+	expect(t, os.Getenv("LISTEN_FDS"), "")
+
+	resp, err := http.Get("http://" + tcp.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	expect(t, string(body), "activated")
+
+	cancel()
+	n, err = notify.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, string(buf[:n]), "STOPPING=1")
+	expect(t, <-errc, nil)
+
+	_, err = SystemdListener("public")
+	refute(t, err, nil)
+}
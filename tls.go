@@ -0,0 +1,226 @@
+package vermouth
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ClientCertCtxKey is a key to be used when the verified TLS client certificate is bound to context object.
+var ClientCertCtxKey = "vermouth.ClientCert"
+
+// ErrNoCertificate is returned by ServeTLS when no certificate is configured.
+var ErrNoCertificate = errors.New("vermouth: no TLS certificate")
+
+// ClientCertificate returns the verified TLS client certificate of the
+// request, or nil if the client did not present one which was verified
+// against Options.TLSClientCAFile.
+func ClientCertificate(ctx context.Context) *x509.Certificate {
+	c, _ := ctx.Value(ClientCertCtxKey).(*x509.Certificate)
+	return c
+}
+
+// NewClientCertContext returns a copy of ctx which carries the client certificate.
+func NewClientCertContext(ctx context.Context, cert *x509.Certificate) context.Context {
+	return context.WithValue(ctx, ClientCertCtxKey, cert)
+}
+
+// CertReloader serves TLS certificates from files and reloads them when the
+// files change, so certificates can be rotated without a restart. Its
+// GetCertificate method is meant for tls.Config.GetCertificate.
+//
+// With more than one certificate, the one matching the server name and
+// capabilities of the client is selected, falling back to the first.
+type CertReloader struct {
+	// Interval is how often the files are checked for changes. The check
+	// happens on handshakes. If zero, the files are checked every minute.
+	Interval time.Duration
+
+	mu    sync.Mutex
+	pairs []*certPair
+}
+
+type certPair struct {
+	certFile, keyFile string
+	cert              *tls.Certificate
+	certMod, keyMod   time.Time
+	checked           time.Time
+}
+
+// NewCertReloader returns a CertReloader serving the key pair of certFile
+// and keyFile.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	cr := &CertReloader{}
+	if err := cr.Add(certFile, keyFile); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// Add loads another key pair, which is selected by SNI.
+func (cr *CertReloader) Add(certFile, keyFile string) error {
+	p := &certPair{certFile: certFile, keyFile: keyFile}
+	if err := p.load(); err != nil {
+		return err
+	}
+	cr.mu.Lock()
+	cr.pairs = append(cr.pairs, p)
+	cr.mu.Unlock()
+	return nil
+}
+
+// Reload reloads every key pair whose files changed. A pair which fails to
+// load keeps its previous certificate, and the first error is returned.
+func (cr *CertReloader) Reload() error {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return cr.reload(time.Now(), true)
+}
+
+func (cr *CertReloader) reload(now time.Time, force bool) error {
+	interval := cr.Interval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	var first error
+	for _, p := range cr.pairs {
+		if !force && now.Sub(p.checked) < interval {
+			continue
+		}
+		p.checked = now
+		if !p.changed() {
+			continue
+		}
+		if err := p.load(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// GetCertificate returns the certificate for a TLS handshake.
+func (cr *CertReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.reload(time.Now(), false)
+	if len(cr.pairs) == 0 {
+		return nil, ErrNoCertificate
+	}
+	if len(cr.pairs) > 1 && hello != nil {
+		for _, p := range cr.pairs {
+			if hello.SupportsCertificate(p.cert) == nil {
+				return p.cert, nil
+			}
+		}
+	}
+	return cr.pairs[0].cert, nil
+}
+
+func (p *certPair) changed() bool {
+	certMod, keyMod := modTime(p.certFile), modTime(p.keyFile)
+	return !certMod.Equal(p.certMod) || !keyMod.Equal(p.keyMod)
+}
+
+func (p *certPair) load() error {
+	certMod, keyMod := modTime(p.certFile), modTime(p.keyFile)
+	cert, err := tls.LoadX509KeyPair(p.certFile, p.keyFile)
+	if err != nil {
+		return fmt.Errorf("vermouth: loading certificate %s: %v", p.certFile, err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fmt.Errorf("vermouth: loading certificate %s: %v", p.certFile, err)
+		}
+	}
+	p.cert, p.certMod, p.keyMod = &cert, certMod, keyMod
+	return nil
+}
+
+func modTime(name string) time.Time {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+// AddCertificate adds a key pair served by ServeTLS next to the one passed
+// to it. The certificate is selected by the server name the client asks for.
+func (vm *Vermouth) AddCertificate(certFile, keyFile string) *Vermouth {
+	vm.certs = append(vm.certs, [2]string{certFile, keyFile})
+	return vm
+}
+
+// ServeTLS is like Serve, but accepts HTTPS connections with the key pair of
+// certFile and keyFile, plus those added with AddCertificate. Options.TLSConfig
+// is used as a template. The certificate files are reloaded when they change.
+//
+// If Options.TLSClientCAFile is set, clients must present a certificate
+// signed by one of its authorities, and the verified certificate is
+// available to handlers through ClientCertificate.
+func (vm *Vermouth) ServeTLS(addr, certFile, keyFile string) error {
+	config, err := vm.tlsConfig(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	l, err := vm.listen(addr)
+	if err != nil {
+		return err
+	}
+	return vm.serveAll([]net.Listener{l}, []string{addr}, config)
+}
+
+func (vm *Vermouth) tlsConfig(certFile, keyFile string) (*tls.Config, error) {
+	opts := vm.Options
+	if opts == nil {
+		opts = defaultOptions()
+	}
+	var config *tls.Config
+	if opts.TLSConfig != nil {
+		config = opts.TLSConfig.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	cr := &CertReloader{Interval: opts.TLSReloadInterval}
+	for _, pair := range append([][2]string{{certFile, keyFile}}, vm.certs...) {
+		if pair[0] == "" && pair[1] == "" {
+			continue
+		}
+		if err := cr.Add(pair[0], pair[1]); err != nil {
+			return nil, err
+		}
+	}
+	if len(cr.pairs) > 0 {
+		config.GetCertificate = cr.GetCertificate
+	} else if len(config.Certificates) == 0 && config.GetCertificate == nil {
+		return nil, ErrNoCertificate
+	}
+
+	if opts.TLSClientCAFile != "" {
+		pem, err := ioutil.ReadFile(opts.TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("vermouth: no certificates in %s", opts.TLSClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if opts.TLSClientAuth != tls.NoClientCert {
+		config.ClientAuth = opts.TLSClientAuth
+	}
+	return config, nil
+}
@@ -0,0 +1,244 @@
+package vermouth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCert(t *testing.T, cn string, serial int64, parent *testCert, isCA bool, dnsNames ...string) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: cn},
+		DNSNames:              dnsNames,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if len(dnsNames) == 0 && !isCA {
+		tmpl.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+	parentCert, parentKey := tmpl, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+// write stores the certificate and key as PEM files in dir.
+func (c *testCert) write(t *testing.T, dir, name string) (string, string) {
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key, Leaf: c.cert}
+}
+
+func TestCertReloaderReloadsChangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", 1, nil, true)
+	certFile, keyFile := newTestCert(t, "server", 10, ca, false).write(t, dir, "server")
+
+	cr, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr.Interval = time.Nanosecond
+	cert, err := cr.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, cert.Leaf.SerialNumber.Int64(), int64(10))
+
+	newTestCert(t, "server", 11, ca, false).write(t, dir, "server")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	os.Chtimes(keyFile, future, future)
+	cert, err = cr.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, cert.Leaf.SerialNumber.Int64(), int64(11))
+
+	// a broken file keeps the previous certificate
+	ioutil.WriteFile(certFile, []byte("garbage"), 0600)
+	future = future.Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	refute(t, cr.Reload(), nil)
+	cert, _ = cr.GetCertificate(&tls.ClientHelloInfo{})
+	expect(t, cert.Leaf.SerialNumber.Int64(), int64(11))
+}
+
+func TestCertReloaderSelectsCertificateBySNI(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", 1, nil, true)
+	cr, err := NewCertReloader(newTestCert(t, "a", 20, ca, false, "a.example.com").write(t, dir, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cr.Add(newTestCert(t, "b", 21, ca, false, "b.example.com").write(t, dir, "b")); err != nil {
+		t.Fatal(err)
+	}
+
+	hello := func(name string) *tls.ClientHelloInfo {
+		return &tls.ClientHelloInfo{
+			ServerName:        name,
+			SupportedVersions: []uint16{tls.VersionTLS13},
+			SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		}
+	}
+	cert, _ := cr.GetCertificate(hello("b.example.com"))
+	expect(t, cert.Leaf.SerialNumber.Int64(), int64(21))
+	cert, _ = cr.GetCertificate(hello("a.example.com"))
+	expect(t, cert.Leaf.SerialNumber.Int64(), int64(20))
+	cert, _ = cr.GetCertificate(hello("c.example.com"))
+	expect(t, cert.Leaf.SerialNumber.Int64(), int64(20))
+}
+
+func TestServeTLSClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", 1, nil, true)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := newTestCert(t, "server", 2, ca, false).write(t, dir, "server")
+	client := newTestCert(t, "alice", 3, ca, false)
+
+	vm := New()
+	vm.Options.TLSClientCAFile = caFile
+	vm.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		if cert := ClientCertificate(r.Context()); cert != nil {
+			w.Write([]byte(cert.Subject.CommonName))
+		}
+	})
+	config, err := vm.tlsConfig(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, config.ClientAuth, tls.RequireAndVerifyClientCert)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: vm}
+	go srv.Serve(tls.NewListener(l, config))
+	defer srv.Close()
+	url := "https://" + l.Addr().String() + "/"
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	newClient := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      roots,
+			Certificates: certs,
+		}}}
+	}
+
+	resp, err := newClient(client.tlsCertificate()).Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	expect(t, string(body), "alice")
+
+	if _, err := newClient().Get(url); err == nil {
+		t.Fatal("expected the handshake to fail without a client certificate")
+	}
+}
+
+func TestServeTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", 1, nil, true)
+	certFile, keyFile := newTestCert(t, "server", 2, ca, false).write(t, dir, "server")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	vm := New().WithContext(ctx)
+	vm.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+	errc := make(chan error, 1)
+	go func() { errc <- vm.ServeTLS(addr, certFile, keyFile) }()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	c := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots},
+		ForceAttemptHTTP2: true,
+	}}
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		if resp, err = c.Get("https://" + addr + "/"); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	expect(t, string(body), "HTTP/2.0")
+
+	cancel()
+	select {
+	case err := <-errc:
+		expect(t, err, nil)
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeTLS did not return after shutdown")
+	}
+}
+
+func TestServeTLSWithoutCertificate(t *testing.T) {
+	expect(t, New().ServeTLS("127.0.0.1:0", "", ""), ErrNoCertificate)
+}
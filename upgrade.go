@@ -0,0 +1,252 @@
+package vermouth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Environment variables passing listeners from a process to its upgrade.
+const (
+	envUpgradeFds     = "VERMOUTH_LISTEN_FDS"
+	envUpgradeNames   = "VERMOUTH_LISTEN_FDNAMES"
+	envUpgradeReadyFd = "VERMOUTH_READY_FD"
+)
+
+// ErrNotServing is returned by Upgrade when vermouth is not serving.
+var ErrNotServing = errors.New("vermouth: not serving")
+
+// serveState tracks the listeners of a running ServeAll.
+type serveState struct {
+	mu        sync.Mutex
+	listeners []net.Listener
+	names     []string
+	stop      context.CancelFunc
+	upgrading bool
+}
+
+func (s *serveState) set(listeners []net.Listener, names []string, stop context.CancelFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners, s.names, s.stop = listeners, names, stop
+}
+
+// Upgrade re-executes the running binary with the same arguments and passes
+// it the listening sockets. Once the new process has run its start hooks and
+// serves, the current process shuts down gracefully within GracefulTimeout,
+// and Serve returns.
+//
+// The new process receives the sockets from Listen, Serve and ServeAddrs
+// when called with the same addresses; listeners given to ServeAll directly
+// are named "network://address". If the new process fails to become ready
+// within Options.UpgradeTimeout, it is killed and the current process keeps
+// serving.
+//
+// Upgrade is called on SIGUSR2 when Options.HotRestart is set.
+func (vm *Vermouth) Upgrade() error {
+	s := &vm.serving
+	s.mu.Lock()
+	if s.stop == nil {
+		s.mu.Unlock()
+		return ErrNotServing
+	}
+	if s.upgrading {
+		s.mu.Unlock()
+		return errors.New("vermouth: upgrade already in progress")
+	}
+	s.upgrading = true
+	listeners, names, stop := s.listeners, s.names, s.stop
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.upgrading = false
+		s.mu.Unlock()
+	}()
+
+	timeout := time.Minute
+	if vm.Options != nil && vm.Options.UpgradeTimeout > 0 {
+		timeout = vm.Options.UpgradeTimeout
+	}
+	if err := startUpgrade(listeners, names, timeout); err != nil {
+		return err
+	}
+	for _, l := range listeners {
+		// the socket file now belongs to the new process as well
+		if ul, ok := l.(interface{ SetUnlinkOnClose(bool) }); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	stop()
+	return nil
+}
+
+type fileListener interface {
+	File() (*os.File, error)
+}
+
+func startUpgrade(listeners []net.Listener, names []string, timeout time.Duration) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for i, l := range listeners {
+		fl, ok := l.(fileListener)
+		if !ok {
+			return fmt.Errorf("vermouth: listener %s cannot be passed to another process", names[i])
+		}
+		f, err := fl.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+	files = append(files, readyW)
+
+	encoded, err := json.Marshal(names)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		envUpgradeFds+"="+strconv.Itoa(len(listeners)),
+		envUpgradeNames+"="+string(encoded),
+		envUpgradeReadyFd+"="+strconv.Itoa(listenFdsStart+len(listeners)),
+	)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// only the new process may hold the write end, so a crash reads as EOF
+	readyW.Close()
+	files = files[:len(files)-1]
+
+	result := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		if _, err := ready.Read(b); err != nil {
+			result <- errors.New("vermouth: upgraded process exited before it was ready")
+			return
+		}
+		result <- nil
+	}()
+	select {
+	case err = <-result:
+	case <-time.After(timeout):
+		err = errors.New("vermouth: upgraded process did not become ready in time")
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		go cmd.Wait()
+		return err
+	}
+	// the new process is not waited for; it outlives this one
+	cmd.Process.Release()
+	return nil
+}
+
+func (vm *Vermouth) handleUpgradeSignals(ctx context.Context) {
+	if len(upgradeSignals) == 0 {
+		return
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, upgradeSignals...)
+	go func() {
+		defer signal.Stop(sigs)
+		for {
+			select {
+			case <-sigs:
+				if err := vm.Upgrade(); err != nil {
+					vm.logf("vermouth: upgrade failed: %v", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (vm *Vermouth) logf(format string, args ...interface{}) {
+	if vm.Options != nil && vm.Options.ErrorLog != nil {
+		vm.Options.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+var (
+	upgradeOnce      sync.Once
+	upgradeMu        sync.Mutex
+	upgradeInherited map[string]net.Listener
+)
+
+// inheritedListener takes the listener passed by the former process for addr.
+func inheritedListener(addr string) net.Listener {
+	upgradeOnce.Do(func() {
+		upgradeInherited = inheritUpgradeListeners()
+	})
+	upgradeMu.Lock()
+	defer upgradeMu.Unlock()
+	l := upgradeInherited[addr]
+	delete(upgradeInherited, addr)
+	return l
+}
+
+func inheritUpgradeListeners() map[string]net.Listener {
+	n, err := strconv.Atoi(os.Getenv(envUpgradeFds))
+	if err != nil || n <= 0 {
+		return nil
+	}
+	var names []string
+	if err := json.Unmarshal([]byte(os.Getenv(envUpgradeNames)), &names); err != nil || len(names) != n {
+		return nil
+	}
+	os.Unsetenv(envUpgradeFds)
+	os.Unsetenv(envUpgradeNames)
+
+	ls := make(map[string]net.Listener, n)
+	for i, name := range names {
+		f := os.NewFile(uintptr(listenFdsStart+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err == nil {
+			ls[name] = l
+		}
+	}
+	return ls
+}
+
+// notifyReady tells the service manager, and the process which started this
+// one with Upgrade, that the server is ready.
+func notifyReady() {
+	fd, err := strconv.Atoi(os.Getenv(envUpgradeReadyFd))
+	if err != nil {
+		SdNotify("READY=1")
+		return
+	}
+	os.Unsetenv(envUpgradeReadyFd)
+	SdNotify("MAINPID=" + strconv.Itoa(os.Getpid()) + "\nREADY=1")
+	f := os.NewFile(uintptr(fd), "ready")
+	f.Write([]byte{1})
+	f.Close()
+}
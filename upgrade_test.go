@@ -0,0 +1,76 @@
+//go:build !windows
+
+package vermouth
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+const envUpgradeTestAddr = "VERMOUTH_UPGRADE_TEST_ADDR"
+
+// TestMain runs the process started by Upgrade in TestUpgrade: it serves
+// the inherited listener for a while and exits.
+func TestMain(m *testing.M) {
+	if addr := os.Getenv(envUpgradeTestAddr); addr != "" && os.Getenv(envUpgradeFds) != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		vm := New().WithContext(ctx)
+		vm.Get("/", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("child"))
+		})
+		if err := vm.Serve(addr); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestUpgrade(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := "tcp://" + l.Addr().String()
+	os.Setenv(envUpgradeTestAddr, name)
+	defer os.Unsetenv(envUpgradeTestAddr)
+
+	vm := New()
+	vm.Options.GracefulTimeout = time.Second
+	vm.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("parent"))
+	})
+	expect(t, vm.Upgrade(), ErrNotServing)
+
+	errc := make(chan error, 1)
+	go func() { errc <- vm.ServeAll(l) }()
+
+	get := func() string {
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		resp, err := client.Get("http://" + l.Addr().String() + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+	expect(t, get(), "parent")
+
+	if err := vm.Upgrade(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errc:
+		expect(t, err, nil)
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeAll did not return after the upgrade")
+	}
+	expect(t, get(), "child")
+}
@@ -0,0 +1,328 @@
+package vermouth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// ValidationFunc checks a field value against the parameter of its rule,
+// e.g. "100" for "max=100", and returns an error describing the violation.
+// Pointers are dereferenced before the function is called.
+type ValidationFunc func(v reflect.Value, param string) error
+
+var (
+	validatorsMu sync.RWMutex
+	validators   = map[string]ValidationFunc{
+		"min":   validateMin,
+		"max":   validateMax,
+		"len":   validateLen,
+		"email": validateEmail,
+		"url":   validateURL,
+		"oneof": validateOneOf,
+	}
+)
+
+// RegisterValidation registers a rule usable in validate tags.
+// Registering a name twice replaces the former rule.
+func RegisterValidation(name string, fn ValidationFunc) {
+	switch name {
+	case "", "required", "omitempty", "dive":
+		panic("vermouth: reserved validation name " + strconv.Quote(name))
+	}
+	validatorsMu.Lock()
+	defer validatorsMu.Unlock()
+	validators[name] = fn
+}
+
+// ValidationError is returned by Validate and lists every violated rule.
+type ValidationError struct {
+	Fields []*FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.Error()
+	}
+	return "vermouth: validation failed: " + strings.Join(msgs, "; ")
+}
+
+// StatusCode returns 422 Unprocessable Entity.
+func (e *ValidationError) StatusCode() int {
+	return http.StatusUnprocessableEntity
+}
+
+// FieldErrors returns the violated fields.
+func (e *ValidationError) FieldErrors() []*FieldError {
+	return e.Fields
+}
+
+// Validate checks the struct pointed to by v against the rules of its
+// validate tags, e.g.
+//
+//	Name  string   `json:"name" validate:"required,max=100"`
+//	Email string   `json:"email" validate:"omitempty,email"`
+//	Kind  string   `query:"kind" validate:"oneof=a b c"`
+//	Tags  []string `json:"tags" validate:"max=10,dive,min=1"`
+//
+// Nested structs, and structs in slices, are validated recursively.
+// Rules after "dive" apply to each element of a slice or map.
+// Errors name the source of the field as Bind reads it: the path, query,
+// header or form parameter, or a JSON pointer into the body.
+func Validate(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		panic("vermouth: Validate requires a struct")
+	}
+	val := &validation{}
+	val.validateStruct(rv, "", "")
+	if len(val.errs) > 0 {
+		return &ValidationError{Fields: val.errs}
+	}
+	return nil
+}
+
+type validation struct {
+	errs []*FieldError
+}
+
+func (val *validation) validateStruct(v reflect.Value, field, pointer string) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		loc := fieldLocation{field: field + sf.Name}
+		loc.source, loc.name = fieldSource(sf, pointer)
+		val.validateValue(v.Field(i), loc, sf.Tag.Get("validate"))
+	}
+}
+
+type fieldLocation struct {
+	source string
+	name   string
+	field  string
+}
+
+func (loc fieldLocation) index(i interface{}) fieldLocation {
+	s := fmt.Sprint(i)
+	loc.field += "[" + s + "]"
+	if loc.source == SourceBody {
+		loc.name += "/" + escapePointer(s)
+	}
+	return loc
+}
+
+func (val *validation) validateValue(v reflect.Value, loc fieldLocation, tag string) {
+	rules, dive := splitRules(tag)
+	for _, rule := range rules {
+		name, param := rule, ""
+		if i := strings.IndexByte(rule, '='); i >= 0 {
+			name, param = rule[:i], rule[i+1:]
+		}
+		switch name {
+		case "required":
+			if isEmptyValue(v) {
+				val.fail(v, loc, errors.New("is required"))
+				return
+			}
+			continue
+		case "omitempty":
+			if isEmptyValue(v) {
+				return
+			}
+			continue
+		}
+		validatorsMu.RLock()
+		fn, ok := validators[name]
+		validatorsMu.RUnlock()
+		if !ok {
+			panic("vermouth: unknown validation rule " + strconv.Quote(name))
+		}
+		iv := reflect.Indirect(v)
+		if !iv.IsValid() {
+			continue
+		}
+		if err := fn(iv, param); err != nil {
+			val.fail(v, loc, err)
+			return
+		}
+	}
+
+	v = reflect.Indirect(v)
+	switch v.Kind() {
+	case reflect.Struct:
+		if v.Type() != timeType {
+			val.validateStruct(v, loc.field+".", loc.name)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if dive != "" || isStructValue(v.Index(i)) {
+				val.validateValue(v.Index(i), loc.index(i), dive)
+			}
+		}
+	case reflect.Map:
+		if dive != "" {
+			for _, key := range v.MapKeys() {
+				val.validateValue(v.MapIndex(key), loc.index(key.Interface()), dive)
+			}
+		}
+	}
+}
+
+func (val *validation) fail(v reflect.Value, loc fieldLocation, err error) {
+	fe := &FieldError{Source: loc.source, Name: loc.name, Field: loc.field, Err: err}
+	if iv := reflect.Indirect(v); iv.IsValid() {
+		switch iv.Kind() {
+		case reflect.String, reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Float32, reflect.Float64:
+			fe.Value = fmt.Sprint(iv.Interface())
+		}
+	}
+	val.errs = append(val.errs, fe)
+}
+
+// fieldSource returns where Bind reads the field sf from.
+func fieldSource(sf reflect.StructField, pointer string) (string, string) {
+	for _, source := range []string{SourcePath, SourceQuery, SourceHeader, SourceForm} {
+		if name := tagName(sf, source); name != "" {
+			return source, name
+		}
+	}
+	name := sf.Name
+	if tag := sf.Tag.Get("json"); tag != "" {
+		if n := strings.Split(tag, ",")[0]; n != "" && n != "-" {
+			name = n
+		}
+	}
+	if sf.Anonymous && sf.Tag.Get("json") == "" {
+		return SourceBody, pointer
+	}
+	return SourceBody, pointer + "/" + escapePointer(name)
+}
+
+func splitRules(tag string) (rules []string, dive string) {
+	if tag == "" {
+		return nil, ""
+	}
+	if i := strings.Index(tag, ",dive"); i >= 0 && (len(tag) == i+5 || tag[i+5] == ',') {
+		dive = strings.TrimPrefix(tag[i+5:], ",")
+		tag = tag[:i]
+	} else if tag == "dive" || strings.HasPrefix(tag, "dive,") {
+		return nil, strings.TrimPrefix(tag[4:], ",")
+	}
+	return strings.Split(tag, ","), dive
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	case reflect.Slice, reflect.Map, reflect.String, reflect.Array:
+		return v.Len() == 0
+	}
+	return v.IsZero()
+}
+
+func isStructValue(v reflect.Value) bool {
+	v = reflect.Indirect(v)
+	return v.Kind() == reflect.Struct && v.Type() != timeType
+}
+
+// measure returns the number compared by min, max and len: the length of
+// strings, slices and maps, or the value of numbers.
+func measure(v reflect.Value) (float64, bool, error) {
+	switch v.Kind() {
+	case reflect.String:
+		return float64(utf8.RuneCountInString(v.String())), true, nil
+	case reflect.Slice, reflect.Map, reflect.Array:
+		return float64(v.Len()), true, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), false, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), false, nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), false, nil
+	}
+	return 0, false, fmt.Errorf("vermouth: cannot measure %s", v.Type())
+}
+
+func compare(v reflect.Value, param string, ok func(n, limit float64) bool, length, value string) error {
+	limit, err := strconv.ParseFloat(param, 64)
+	if err != nil {
+		panic("vermouth: invalid validation parameter " + strconv.Quote(param))
+	}
+	n, isLength, err := measure(v)
+	if err != nil {
+		panic(err)
+	}
+	if ok(n, limit) {
+		return nil
+	}
+	if isLength {
+		return fmt.Errorf(length, param)
+	}
+	return fmt.Errorf(value, param)
+}
+
+func validateMin(v reflect.Value, param string) error {
+	return compare(v, param, func(n, limit float64) bool { return n >= limit },
+		"must have a length of at least %s", "must be at least %s")
+}
+
+func validateMax(v reflect.Value, param string) error {
+	return compare(v, param, func(n, limit float64) bool { return n <= limit },
+		"must have a length of at most %s", "must be at most %s")
+}
+
+func validateLen(v reflect.Value, param string) error {
+	return compare(v, param, func(n, limit float64) bool { return n == limit },
+		"must have a length of %s", "must be %s")
+}
+
+func validateEmail(v reflect.Value, param string) error {
+	addr, err := mail.ParseAddress(v.String())
+	if err != nil || addr.Address != v.String() {
+		return errors.New("must be a valid email address")
+	}
+	return nil
+}
+
+func validateURL(v reflect.Value, param string) error {
+	u, err := url.Parse(v.String())
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return errors.New("must be a valid absolute URL")
+	}
+	return nil
+}
+
+func validateOneOf(v reflect.Value, param string) error {
+	s := fmt.Sprint(v.Interface())
+	options := strings.Fields(param)
+	for _, o := range options {
+		if s == o {
+			return nil
+		}
+	}
+	return fmt.Errorf("must be one of %s", strings.Join(options, ", "))
+}
+
+func escapePointer(s string) string {
+	s = strings.Replace(s, "~", "~0", -1)
+	return strings.Replace(s, "/", "~1", -1)
+}
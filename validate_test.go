@@ -0,0 +1,93 @@
+package vermouth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type validateAddress struct {
+	City string `json:"city" validate:"required"`
+}
+
+type validateTarget struct {
+	ID        int               `path:"id" validate:"min=1"`
+	Kind      string            `query:"kind" validate:"omitempty,oneof=a b c"`
+	Name      string            `json:"name" validate:"required,max=5"`
+	Email     string            `json:"email" validate:"email"`
+	Tags      []string          `json:"tags" validate:"max=2,dive,min=2"`
+	Addresses []validateAddress `json:"addresses"`
+	Home      *validateAddress  `json:"home"`
+	Even      int               `json:"even" validate:"even"`
+}
+
+func init() {
+	RegisterValidation("even", func(v reflect.Value, param string) error {
+		if v.Int()%2 != 0 {
+			return errors.New("must be even")
+		}
+		return nil
+	})
+}
+
+func TestValidate(t *testing.T) {
+	ok := validateTarget{ID: 1, Name: "alice", Email: "a@example.com", Tags: []string{"go"}}
+	expect(t, Validate(&ok), nil)
+
+	bad := validateTarget{
+		Kind:      "d",
+		Name:      "bartholomew",
+		Email:     "not an email",
+		Tags:      []string{"go", "x"},
+		Addresses: []validateAddress{{City: "Tokyo"}, {}},
+		Home:      &validateAddress{},
+		Even:      3,
+	}
+	err := Validate(&bad)
+	ve, isValidation := err.(*ValidationError)
+	if !isValidation {
+		t.Fatalf("expected *ValidationError, got %v", err)
+	}
+	var got []string
+	for _, f := range ve.Fields {
+		got = append(got, f.Source+" "+f.Name)
+	}
+	expect(t, strings.Join(got, ", "), "path id, query kind, body /name, body /email, body /tags/1, body /addresses/1/city, body /home/city, body /even")
+	expect(t, ve.StatusCode(), http.StatusUnprocessableEntity)
+}
+
+func TestBindValidationRendersUnprocessableEntity(t *testing.T) {
+	vm := New()
+	vm.Post("/users/:id", func(w http.ResponseWriter, r *http.Request) error {
+		var dst validateTarget
+		if err := Bind(r, &dst); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	})
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/users/7", strings.NewReader(`{"name":"","email":"a@example.com"}`))
+	req.Header.Set("Content-Type", "application/json")
+	vm.ServeHTTP(rec, req)
+
+	expect(t, rec.Code, http.StatusUnprocessableEntity)
+	var body struct {
+		Fields []struct {
+			Source  string `json:"source"`
+			Name    string `json:"name"`
+			Message string `json:"message"`
+		} `json:"fields"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, len(body.Fields), 1)
+	expect(t, body.Fields[0].Name, "/name")
+	expect(t, body.Fields[0].Message, "is required")
+}
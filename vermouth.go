@@ -7,10 +7,9 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"os"
 	"strings"
 	"time"
-
-	"github.com/tylerb/graceful"
 )
 
 // Handler is an interface that objects can implement to be registered to serve as middleware
@@ -29,6 +28,7 @@ type (
 	// interface{} that is named for the purposes of documentation, however only the
 	// following concrete types are accepted:
 	// 	- func(http.ResponseWriter, *http.Request)
+	// 	- func(http.ResponseWriter, *http.Request) error
 	// 	- types that implement http.Handler
 	HandlerType interface{}
 
@@ -63,16 +63,19 @@ type Vermouth struct {
 	ctx      context.Context
 	router   *Router
 	handlers []Handler
+	hooks    lifecycleHooks
+	serving  serveState
+	certs    [][2]string
 	Options  *Options
 }
 
 // Options for vermouth app
-// This is used by initializing http.Server and graceful.Server
+// This is used by initializing Server
 type Options struct {
 	ReadTimeout    time.Duration // maximum duration before timing out read of the request
 	WriteTimeout   time.Duration // maximum duration before timing out write of the response
 	MaxHeaderBytes int           // maximum size of request headers, DefaultMaxHeaderBytes if 0
-	TLSConfig      *tls.Config   // optional TLS config, used by ListenAndServeTLS
+	TLSConfig      *tls.Config   // optional TLS config, used as a template by ServeTLS
 
 	// TLSNextProto optionally specifies a function to take over
 	// ownership of the provided TLS connection when an NPN
@@ -84,28 +87,80 @@ type Options struct {
 	// If TLSNextProto is nil, HTTP/2 support is enabled automatically.
 	TLSNextProto map[string]func(*http.Server, *tls.Conn, http.Handler)
 
+	// H2C enables cleartext HTTP/2 with prior knowledge next to HTTP/1.1
+	// on the same listeners. HTTP/1.1 requests asking to upgrade to h2c,
+	// which RFC 9113 deprecates, are answered over HTTP/1.1.
+	H2C bool
+
+	// HTTP2 optionally configures HTTP/2, such as the maximum number of
+	// concurrent streams and the frame sizes, for both h2 and h2c.
+	HTTP2 *http.HTTP2Config
+
 	// ConnState specifies an optional callback function that is
 	// called when a client connection changes state. See the
 	// ConnState type and associated constants for details.
 	ConnState func(net.Conn, http.ConnState)
 
 	// Timeout is the duration to allow outstanding requests to survive
-	// before forcefully terminating them.
+	// before forcefully terminating them. Shutdown hooks share this deadline.
 	GracefulTimeout time.Duration
 
-	// Limit the number of outstanding requests
+	// StartTimeout limits the time all start hooks may take together.
+	// If zero, start hooks are only bound by the vermouth context.
+	StartTimeout time.Duration
+
+	// Limit the number of outstanding connections
 	ListenLimit int
 
 	// ShutdownInitiated is an optional callback function that is called
-	// when shutdown is initiated. It can be used to notify the client
-	// side of long lived connections (e.g. websockets) to reconnect.
+	// once when shutdown is initiated, before the connections are drained.
+	// It can be used to notify the client side of long lived connections
+	// (e.g. websockets) to reconnect.
 	ShutdownInitiated func()
 
-	// NoSignalHandling prevents graceful from automatically shutting down
+	// NoSignalHandling prevents the server from automatically shutting down
 	// on SIGINT and SIGTERM. If set to true, you must shut down the server
-	// manually with Stop().
+	// manually with Stop() or by cancelling the vermouth context.
 	NoSignalHandling bool
 
+	// HotRestart enables zero-downtime binary upgrades on SIGUSR2, see Upgrade.
+	HotRestart bool
+
+	// UpgradeTimeout is the time a new process started by Upgrade has to
+	// become ready. If zero, it defaults to one minute.
+	UpgradeTimeout time.Duration
+
+	// TLSReloadInterval is how often ServeTLS checks the certificate files
+	// for changes. If zero, they are checked every minute.
+	TLSReloadInterval time.Duration
+
+	// TLSClientCAFile is a PEM bundle of certificate authorities which
+	// ServeTLS verifies client certificates against. Client certificates
+	// are required unless TLSClientAuth says otherwise.
+	TLSClientCAFile string
+	TLSClientAuth   tls.ClientAuthType
+
+	// ProxyProtocol makes the servers read HAProxy PROXY protocol headers,
+	// so that RemoteAddr is the address of the client instead of the proxy.
+	// Headers are only read from ProxyProtocolTrusted networks, in CIDR
+	// notation, which must not be empty, as anyone could spoof their
+	// address otherwise. ProxyProtocolTimeout
+	// limits the time to read a header, 10 seconds by default.
+	ProxyProtocol        bool
+	ProxyProtocolTrusted []string
+	ProxyProtocolTimeout time.Duration
+
+	// UnixSocketMode sets the file mode of Unix domain sockets created by
+	// Serve and ServeAddrs. If zero, the mode is left to the umask. The
+	// socket is created in a private directory and moved into place once
+	// its mode and owner are set, so it needs a writable parent directory.
+	UnixSocketMode os.FileMode
+
+	// UnixSocketOwner sets the owner of Unix domain sockets created by Serve
+	// and ServeAddrs, as "user", "user:group" or ":group". Names and numeric
+	// IDs are accepted.
+	UnixSocketOwner string
+
 	// ErrorLog specifies an optional logger for errors accepting
 	// connections and unexpected behavior from handlers.
 	// If nil, logging goes to os.Stderr via the log package's
@@ -162,23 +217,73 @@ func (vm *Vermouth) Handle(method, pattern string, handler HandlerType) *Vermout
 
 func (vm *Vermouth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	md := build(append(vm.handlers, wrapHandler(vm.router)))
-	md.ServeHTTP(NewResponseWriter(w), r.WithContext(vm.ctx))
+	vm.serve(md, w, r)
+}
+
+// compile builds the middleware stack once and returns it as an http.Handler.
+// Handlers registered afterwards are not part of the returned handler.
+func (vm *Vermouth) compile() http.Handler {
+	md := build(append(vm.handlers, wrapHandler(vm.router)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vm.serve(md, w, r)
+	})
+}
+
+// serve runs the middleware stack with a ResponseWriter, whose After
+// functions run when the stack returns or panics.
+func (vm *Vermouth) serve(md middleware, w http.ResponseWriter, r *http.Request) {
+	rw := newResponseWriter(w)
+	defer rw.callAfter()
+	md.ServeHTTP(rw.outer, vm.withContext(r))
 }
 
+// HandlerFunc builds the middleware stack once and returns it as an
+// http.HandlerFunc, which serves requests like ServeHTTP.
 func (vm *Vermouth) HandlerFunc() http.HandlerFunc {
 	md := build(append(vm.handlers, wrapHandler(vm.router)))
 	return func(w http.ResponseWriter, r *http.Request) {
-		md.ServeHTTP(w, r.WithContext(vm.ctx))
+		vm.serve(md, w, r)
 	}
 }
 
+// withContext binds the root context, the serving http.Server and the
+// verified TLS client certificate if any, to the request. The original
+// request context, which is done when the client disconnects, is kept for
+// requestContext.
+func (vm *Vermouth) withContext(r *http.Request) *http.Request {
+	ctx := context.WithValue(vm.ctx, requestCtxKey, r.Context())
+	if srv := r.Context().Value(http.ServerContextKey); srv != nil {
+		ctx = context.WithValue(ctx, http.ServerContextKey, srv)
+	}
+	if reg := r.Context().Value(webSocketsCtxKey); reg != nil {
+		ctx = context.WithValue(ctx, webSocketsCtxKey, reg)
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		ctx = NewClientCertContext(ctx, r.TLS.VerifiedChains[0][0])
+	}
+	return r.WithContext(ctx)
+}
+
+// requestCtxKey binds the original request context to the root context.
+var requestCtxKey = "vermouth.requestContext"
+
+// requestContext returns the context of r as created by the http.Server,
+// which is done when the client disconnects or the handler returns, unlike
+// the root context bound by vermouth.
+func requestContext(r *http.Request) context.Context {
+	if ctx, ok := r.Context().Value(requestCtxKey).(context.Context); ok {
+		return ctx
+	}
+	return r.Context()
+}
+
 // Middlewares returns registered handlers.
 func (vm *Vermouth) Middlewares() []Handler {
 	return vm.handlers
 }
 
 // NewServer returns a new server implements http.Server.
-func (vm *Vermouth) NewServer() *graceful.Server {
+func (vm *Vermouth) NewServer() *Server {
 	opts := vm.Options
 	if opts == nil {
 		opts = defaultOptions()
@@ -190,14 +295,22 @@ func (vm *Vermouth) NewServer() *graceful.Server {
 		MaxHeaderBytes: opts.MaxHeaderBytes,
 		TLSConfig:      opts.TLSConfig,
 		TLSNextProto:   opts.TLSNextProto,
+		ConnState:      opts.ConnState,
 		ErrorLog:       opts.ErrorLog,
+		HTTP2:          opts.HTTP2,
+	}
+	if opts.H2C {
+		srv.Protocols = new(http.Protocols)
+		srv.Protocols.SetHTTP1(true)
+		srv.Protocols.SetHTTP2(true)
+		srv.Protocols.SetUnencryptedHTTP2(true)
 	}
-	return &graceful.Server{
-		Server:           srv,
-		Timeout:          opts.GracefulTimeout,
-		ListenLimit:      opts.ListenLimit,
-		ConnState:        opts.ConnState,
-		NoSignalHandling: opts.NoSignalHandling,
+	return &Server{
+		Server:            srv,
+		Timeout:           opts.GracefulTimeout,
+		ListenLimit:       opts.ListenLimit,
+		ShutdownInitiated: opts.ShutdownInitiated,
+		NoSignalHandling:  opts.NoSignalHandling,
 	}
 }
 
@@ -251,6 +364,8 @@ func wrapHandlerFunc(handler HandlerType) http.HandlerFunc {
 	switch h := handler.(type) {
 	case func(http.ResponseWriter, *http.Request):
 		return h
+	case func(http.ResponseWriter, *http.Request) error:
+		return ErrorHandlerFunc(h).ServeHTTP
 	case http.Handler:
 		return func(w http.ResponseWriter, r *http.Request) {
 			h.ServeHTTP(w, r)
@@ -0,0 +1,699 @@
+package vermouth
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// WebSocket message types.
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+)
+
+const (
+	opContinuation = 0x0
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// WebSocket close codes, as defined by RFC 6455.
+const (
+	CloseNormalClosure           = 1000
+	CloseGoingAway               = 1001
+	CloseProtocolError           = 1002
+	CloseUnsupportedData         = 1003
+	CloseNoStatusReceived        = 1005
+	CloseAbnormalClosure         = 1006
+	CloseInvalidFramePayloadData = 1007
+	ClosePolicyViolation         = 1008
+	CloseMessageTooBig           = 1009
+	CloseMandatoryExtension      = 1010
+	CloseInternalServerErr       = 1011
+	CloseServiceRestart          = 1012
+	CloseTryAgainLater           = 1013
+)
+
+// ErrCloseSent is returned when writing to a WebSocket after a close frame was sent.
+var ErrCloseSent = errors.New("vermouth: websocket close frame already sent")
+
+// DefaultWebSocketReadLimit is the ReadLimit used when WebSocketOptions do not set one.
+var DefaultWebSocketReadLimit int64 = 1 << 20
+
+// WebSocketCloseTimeout is the time a peer has to answer a close frame sent on
+// graceful shutdown before the connection is closed.
+var WebSocketCloseTimeout = 5 * time.Second
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// CloseError is returned by ReadMessage when the connection was closed by a
+// close frame of the peer, or because the peer violated the protocol, in
+// which case Code tells why the connection was closed.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("vermouth: websocket closed: %d %s", e.Code, e.Reason)
+	}
+	return fmt.Sprintf("vermouth: websocket closed: %d", e.Code)
+}
+
+// WebSocketOptions configures Upgrade.
+type WebSocketOptions struct {
+	// Subprotocols lists the supported subprotocols in order of preference.
+	Subprotocols []string
+
+	// CheckOrigin reports whether the Origin of the request is allowed. By
+	// default requests without an Origin header and those whose Origin host
+	// matches the Host header are allowed.
+	CheckOrigin func(r *http.Request) bool
+
+	// ReadLimit is the maximum size of a message, after decompression.
+	// Larger messages close the connection with CloseMessageTooBig. If zero,
+	// DefaultWebSocketReadLimit is used.
+	ReadLimit int64
+
+	// Compression negotiates the permessage-deflate extension when the
+	// client offers it. Messages are compressed without context takeover.
+	Compression bool
+
+	// FragmentSize splits written messages into frames of at most that
+	// many bytes. If zero, every message is sent as a single frame.
+	FragmentSize int
+}
+
+// WebSocket is a WebSocket connection. Reads must happen from one goroutine
+// at a time; writes are safe for concurrent use.
+type WebSocket struct {
+	// OnPing and OnPong, if set, are called with the payload of received
+	// ping and pong frames. Pings are answered with a pong in any case.
+	OnPing func(data []byte)
+	OnPong func(data []byte)
+
+	conn         net.Conn
+	br           *bufio.Reader
+	subprotocol  string
+	compress     bool
+	readLimit    int64
+	fragmentSize int
+	registry     *webSocketRegistry
+
+	writeMu   sync.Mutex
+	closeSent bool
+	readErr   error
+	closeOnce sync.Once
+}
+
+// Upgrade upgrades the HTTP request to the WebSocket protocol. When the
+// handshake fails, an HTTP error response is written and an error returned.
+//
+// Connections of a server started by vermouth receive a CloseGoingAway close
+// frame when the server shuts down gracefully.
+func Upgrade(w http.ResponseWriter, r *http.Request, opts *WebSocketOptions) (*WebSocket, error) {
+	if opts == nil {
+		opts = &WebSocketOptions{}
+	}
+	fail := func(status int, msg string) (*WebSocket, error) {
+		http.Error(w, msg, status)
+		return nil, errors.New("vermouth: websocket: " + msg)
+	}
+	if r.Method != "GET" {
+		return fail(http.StatusMethodNotAllowed, "handshake requires GET")
+	}
+	if !headerContainsToken(r.Header, "Connection", "upgrade") || !headerContainsToken(r.Header, "Upgrade", "websocket") {
+		return fail(http.StatusBadRequest, "not a websocket handshake")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return fail(http.StatusUpgradeRequired, "unsupported websocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if b, err := base64.StdEncoding.DecodeString(key); err != nil || len(b) != 16 {
+		return fail(http.StatusBadRequest, "invalid Sec-WebSocket-Key")
+	}
+	checkOrigin := opts.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	if !checkOrigin(r) {
+		return fail(http.StatusForbidden, "origin not allowed")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return fail(http.StatusInternalServerError, "connection cannot be hijacked")
+	}
+
+	subprotocol := selectSubprotocol(r, opts.Subprotocols)
+	compress := opts.Compression && offersDeflate(r.Header)
+
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	var resp bytes.Buffer
+	resp.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	resp.WriteString("Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n")
+	if subprotocol != "" {
+		resp.WriteString("Sec-WebSocket-Protocol: " + subprotocol + "\r\n")
+	}
+	if compress {
+		resp.WriteString("Sec-WebSocket-Extensions: permessage-deflate; server_no_context_takeover; client_no_context_takeover\r\n")
+	}
+	resp.WriteString("\r\n")
+	conn.SetDeadline(time.Time{})
+	if _, err := conn.Write(resp.Bytes()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	ws := &WebSocket{
+		conn:         conn,
+		br:           brw.Reader,
+		subprotocol:  subprotocol,
+		compress:     compress,
+		readLimit:    opts.ReadLimit,
+		fragmentSize: opts.FragmentSize,
+	}
+	if ws.readLimit <= 0 {
+		ws.readLimit = DefaultWebSocketReadLimit
+	}
+	if reg, ok := r.Context().Value(webSocketsCtxKey).(*webSocketRegistry); ok {
+		ws.registry = reg
+		reg.add(ws)
+	}
+	return ws, nil
+}
+
+// WebSocketHandler returns a handler which upgrades requests and runs fn with
+// the connection, which is closed when fn returns.
+func WebSocketHandler(opts *WebSocketOptions, fn func(ws *WebSocket, r *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ws, err := Upgrade(w, r, opts)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		fn(ws, r)
+	}
+}
+
+func headerContainsToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+func selectSubprotocol(r *http.Request, supported []string) string {
+	var offered []string
+	for _, v := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, p := range strings.Split(v, ",") {
+			offered = append(offered, strings.TrimSpace(p))
+		}
+	}
+	for _, s := range supported {
+		if containsString(offered, s) {
+			return s
+		}
+	}
+	return ""
+}
+
+// offersDeflate reports whether the client offers permessage-deflate with
+// parameters the server can accept.
+func offersDeflate(h http.Header) bool {
+	for _, v := range h.Values("Sec-WebSocket-Extensions") {
+		for _, offer := range strings.Split(v, ",") {
+			params := strings.Split(offer, ";")
+			if strings.TrimSpace(params[0]) != "permessage-deflate" {
+				continue
+			}
+			ok := true
+			for _, p := range params[1:] {
+				p = strings.TrimSpace(p)
+				// the compressor always uses a window of 15 bits
+				if strings.HasPrefix(p, "server_max_window_bits") && strings.Trim(strings.TrimPrefix(p, "server_max_window_bits"), `= "`) != "15" {
+					ok = false
+				}
+			}
+			if ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+websocketGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Subprotocol returns the negotiated subprotocol, or an empty string.
+func (ws *WebSocket) Subprotocol() string {
+	return ws.subprotocol
+}
+
+// Compressed returns whether permessage-deflate was negotiated.
+func (ws *WebSocket) Compressed() bool {
+	return ws.compress
+}
+
+// RemoteAddr returns the address of the peer.
+func (ws *WebSocket) RemoteAddr() net.Addr {
+	return ws.conn.RemoteAddr()
+}
+
+// SetReadDeadline sets the deadline for reads on the underlying connection.
+func (ws *WebSocket) SetReadDeadline(t time.Time) error {
+	return ws.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline for writes on the underlying connection.
+func (ws *WebSocket) SetWriteDeadline(t time.Time) error {
+	return ws.conn.SetWriteDeadline(t)
+}
+
+// ReadMessage reads the next text or binary message, reassembling fragments
+// and answering pings. When the peer closes the connection, the close
+// handshake is completed and a *CloseError is returned.
+func (ws *WebSocket) ReadMessage() (messageType int, data []byte, err error) {
+	if ws.readErr != nil {
+		return 0, nil, ws.readErr
+	}
+	var compressed bool
+	for {
+		fin, rsv1, op, payload, err := ws.readFrame(int64(len(data)))
+		if err != nil {
+			return 0, nil, ws.fail(err)
+		}
+		switch op {
+		case opPing:
+			if err := ws.writeFrame(opPong, payload, true, false); err != nil && err != ErrCloseSent {
+				return 0, nil, ws.fail(err)
+			}
+			if ws.OnPing != nil {
+				ws.OnPing(payload)
+			}
+			continue
+		case opPong:
+			if ws.OnPong != nil {
+				ws.OnPong(payload)
+			}
+			continue
+		case opClose:
+			return 0, nil, ws.receiveClose(payload)
+		case opContinuation:
+			if messageType == 0 || rsv1 {
+				return 0, nil, ws.fail(&CloseError{Code: CloseProtocolError, Reason: "unexpected continuation frame"})
+			}
+		case TextMessage, BinaryMessage:
+			if messageType != 0 {
+				return 0, nil, ws.fail(&CloseError{Code: CloseProtocolError, Reason: "expected continuation frame"})
+			}
+			messageType, compressed = int(op), rsv1
+		default:
+			return 0, nil, ws.fail(&CloseError{Code: CloseProtocolError, Reason: "unknown opcode"})
+		}
+		data = append(data, payload...)
+		if fin {
+			break
+		}
+	}
+	if compressed {
+		if data, err = ws.inflate(data); err != nil {
+			return 0, nil, ws.fail(err)
+		}
+	}
+	if messageType == TextMessage && !utf8.Valid(data) {
+		return 0, nil, ws.fail(&CloseError{Code: CloseInvalidFramePayloadData, Reason: "invalid UTF-8"})
+	}
+	return messageType, data, nil
+}
+
+// readFrame reads a frame; read is the size of the message read so far.
+func (ws *WebSocket) readFrame(read int64) (fin, rsv1 bool, op byte, payload []byte, err error) {
+	var hdr [2]byte
+	if _, err = io.ReadFull(ws.br, hdr[:]); err != nil {
+		return
+	}
+	fin, rsv1, op = hdr[0]&0x80 != 0, hdr[0]&0x40 != 0, hdr[0]&0xf
+	control := op&0x8 != 0
+	switch {
+	case hdr[0]&0x30 != 0:
+		err = &CloseError{Code: CloseProtocolError, Reason: "reserved bits set"}
+	case rsv1 && (!ws.compress || control):
+		err = &CloseError{Code: CloseProtocolError, Reason: "unexpected compressed frame"}
+	case hdr[1]&0x80 == 0:
+		err = &CloseError{Code: CloseProtocolError, Reason: "frame not masked"}
+	case control && (!fin || hdr[1]&0x7f > 125):
+		err = &CloseError{Code: CloseProtocolError, Reason: "invalid control frame"}
+	}
+	if err != nil {
+		return
+	}
+
+	length := int64(hdr[1] & 0x7f)
+	switch length {
+	case 126:
+		var b [2]byte
+		if _, err = io.ReadFull(ws.br, b[:]); err != nil {
+			return
+		}
+		length = int64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err = io.ReadFull(ws.br, b[:]); err != nil {
+			return
+		}
+		length = int64(binary.BigEndian.Uint64(b[:]))
+	}
+	if length < 0 || (!control && read+length > ws.readLimit) {
+		err = &CloseError{Code: CloseMessageTooBig, Reason: "message too big"}
+		return
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(ws.br, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(ws.br, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+func (ws *WebSocket) inflate(data []byte) ([]byte, error) {
+	fr := flate.NewReader(io.MultiReader(bytes.NewReader(data), strings.NewReader("\x00\x00\xff\xff\x01\x00\x00\xff\xff")))
+	defer fr.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(fr, ws.readLimit+1))
+	if err != nil {
+		return nil, &CloseError{Code: CloseInvalidFramePayloadData, Reason: "invalid compressed data"}
+	}
+	if int64(len(b)) > ws.readLimit {
+		return nil, &CloseError{Code: CloseMessageTooBig, Reason: "message too big"}
+	}
+	return b, nil
+}
+
+// receiveClose answers a close frame of the peer and closes the connection.
+func (ws *WebSocket) receiveClose(payload []byte) error {
+	closeErr := &CloseError{Code: CloseNoStatusReceived}
+	switch {
+	case len(payload) == 1:
+		return ws.fail(&CloseError{Code: CloseProtocolError, Reason: "invalid close frame"})
+	case len(payload) >= 2:
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		closeErr.Reason = string(payload[2:])
+		if !validCloseCode(closeErr.Code) {
+			return ws.fail(&CloseError{Code: CloseProtocolError, Reason: "invalid close code"})
+		}
+		if !utf8.Valid(payload[2:]) {
+			return ws.fail(&CloseError{Code: CloseInvalidFramePayloadData, Reason: "invalid UTF-8"})
+		}
+	}
+	var reply []byte
+	if closeErr.Code != CloseNoStatusReceived {
+		reply = payload[:2]
+	}
+	ws.writeFrame(opClose, reply, true, false)
+	ws.readErr = closeErr
+	ws.Close()
+	return closeErr
+}
+
+// fail closes the connection after a read error. Protocol violations are
+// reported to the peer with a close frame.
+func (ws *WebSocket) fail(err error) error {
+	if ce, ok := err.(*CloseError); ok {
+		ws.WriteClose(ce.Code, ce.Reason)
+	}
+	ws.readErr = err
+	ws.Close()
+	return err
+}
+
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// WriteMessage writes a text or binary message.
+func (ws *WebSocket) WriteMessage(messageType int, data []byte) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return fmt.Errorf("vermouth: invalid websocket message type %d", messageType)
+	}
+	compressed := false
+	if ws.compress {
+		var buf bytes.Buffer
+		fw, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+		fw.Write(data)
+		fw.Flush()
+		data = bytes.TrimSuffix(buf.Bytes(), []byte("\x00\x00\xff\xff"))
+		compressed = true
+	}
+
+	ws.writeMu.Lock()
+	defer ws.writeMu.Unlock()
+	op := byte(messageType)
+	for {
+		frame, fin := data, true
+		if ws.fragmentSize > 0 && len(data) > ws.fragmentSize {
+			frame, fin = data[:ws.fragmentSize], false
+		}
+		if err := ws.writeFrameLocked(op, frame, fin, compressed); err != nil {
+			return err
+		}
+		if fin {
+			return nil
+		}
+		data = data[len(frame):]
+		op, compressed = opContinuation, false
+	}
+}
+
+// Ping sends a ping frame. The payload must not exceed 125 bytes.
+func (ws *WebSocket) Ping(data []byte) error {
+	if len(data) > 125 {
+		return errors.New("vermouth: websocket control frame payload too long")
+	}
+	return ws.writeFrame(opPing, data, true, false)
+}
+
+// WriteClose starts the close handshake by sending a close frame with code
+// and reason. The reader receives the answer of the peer as a *CloseError,
+// after which the connection is closed.
+func (ws *WebSocket) WriteClose(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	if len(payload) > 125 {
+		payload = payload[:125]
+	}
+	return ws.writeFrame(opClose, payload, true, false)
+}
+
+// Close closes the connection, sending a CloseNormalClosure close frame
+// first unless one was sent already.
+func (ws *WebSocket) Close() error {
+	var err error
+	ws.closeOnce.Do(func() {
+		ws.WriteClose(CloseNormalClosure, "")
+		if ws.registry != nil {
+			ws.registry.remove(ws)
+		}
+		err = ws.conn.Close()
+	})
+	return err
+}
+
+func (ws *WebSocket) writeFrame(op byte, payload []byte, fin, rsv1 bool) error {
+	ws.writeMu.Lock()
+	defer ws.writeMu.Unlock()
+	return ws.writeFrameLocked(op, payload, fin, rsv1)
+}
+
+func (ws *WebSocket) writeFrameLocked(op byte, payload []byte, fin, rsv1 bool) error {
+	if ws.closeSent {
+		return ErrCloseSent
+	}
+	if op == opClose {
+		ws.closeSent = true
+	}
+	hdr := make([]byte, 2, 10+len(payload))
+	hdr[0] = op
+	if fin {
+		hdr[0] |= 0x80
+	}
+	if rsv1 {
+		hdr[0] |= 0x40
+	}
+	switch n := len(payload); {
+	case n <= 125:
+		hdr[1] = byte(n)
+	case n <= 0xffff:
+		hdr[1] = 126
+		hdr = append(hdr, 0, 0)
+		binary.BigEndian.PutUint16(hdr[2:], uint16(n))
+	default:
+		hdr[1] = 127
+		hdr = append(hdr, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(hdr[2:], uint64(n))
+	}
+	_, err := ws.conn.Write(append(hdr, payload...))
+	return err
+}
+
+// webSocketsCtxKey binds the webSocketRegistry of a Server to the contexts
+// of its connections.
+var webSocketsCtxKey = "vermouth.webSockets"
+
+// webSocketRegistry tracks the open WebSockets of a server, which are no
+// longer seen by its graceful shutdown after they have been hijacked.
+type webSocketRegistry struct {
+	mu      sync.Mutex
+	conns   map[*WebSocket]struct{}
+	closing bool
+	idle    chan struct{}
+}
+
+func newWebSocketRegistry() *webSocketRegistry {
+	return &webSocketRegistry{conns: make(map[*WebSocket]struct{})}
+}
+
+func (reg *webSocketRegistry) add(ws *WebSocket) {
+	reg.mu.Lock()
+	reg.conns[ws] = struct{}{}
+	closing := reg.closing
+	reg.mu.Unlock()
+	if closing {
+		ws.goAway()
+	}
+}
+
+func (reg *webSocketRegistry) remove(ws *WebSocket) {
+	reg.mu.Lock()
+	delete(reg.conns, ws)
+	if len(reg.conns) == 0 && reg.idle != nil {
+		close(reg.idle)
+		reg.idle = nil
+	}
+	reg.mu.Unlock()
+}
+
+func (reg *webSocketRegistry) list() []*WebSocket {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	conns := make([]*WebSocket, 0, len(reg.conns))
+	for ws := range reg.conns {
+		conns = append(conns, ws)
+	}
+	return conns
+}
+
+// shutdown sends a close frame to every connection and gives the peers
+// WebSocketCloseTimeout to answer.
+func (reg *webSocketRegistry) shutdown() {
+	reg.mu.Lock()
+	closing := reg.closing
+	reg.closing = true
+	reg.mu.Unlock()
+	if closing {
+		return
+	}
+	for _, ws := range reg.list() {
+		ws.goAway()
+	}
+}
+
+// wait waits until every connection is closed, and closes the remaining ones
+// when ctx is done or WebSocketCloseTimeout has passed.
+func (reg *webSocketRegistry) wait(ctx context.Context) error {
+	timer := time.NewTimer(WebSocketCloseTimeout)
+	defer timer.Stop()
+	for {
+		reg.mu.Lock()
+		if len(reg.conns) == 0 {
+			reg.mu.Unlock()
+			return nil
+		}
+		if reg.idle == nil {
+			reg.idle = make(chan struct{})
+		}
+		idle := reg.idle
+		reg.mu.Unlock()
+
+		select {
+		case <-idle:
+		case <-timer.C:
+			reg.closeAll()
+			return nil
+		case <-ctx.Done():
+			reg.closeAll()
+			return ctx.Err()
+		}
+	}
+}
+
+func (reg *webSocketRegistry) closeAll() {
+	for _, ws := range reg.list() {
+		// closing the connection first unblocks a stalled writer
+		ws.conn.Close()
+		ws.Close()
+	}
+}
+
+// goAway starts the close handshake with CloseGoingAway. The deadlines keep
+// a stalled peer from holding up the shutdown.
+func (ws *WebSocket) goAway() {
+	deadline := time.Now().Add(WebSocketCloseTimeout)
+	ws.conn.SetWriteDeadline(deadline)
+	ws.WriteClose(CloseGoingAway, "server shutting down")
+	ws.conn.SetReadDeadline(deadline)
+}
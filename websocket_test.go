@@ -0,0 +1,425 @@
+package vermouth
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsClient is a minimal WebSocket client speaking raw frames.
+type wsClient struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+	resp *http.Response
+}
+
+func dialWebSocket(t *testing.T, url string, header http.Header) *wsClient {
+	req, _ := http.NewRequest("GET", url, nil)
+	conn, err := net.Dial("tcp", req.URL.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &wsClient{t: t, conn: conn, br: br, resp: resp}
+}
+
+func (c *wsClient) writeFrame(b0 byte, payload []byte, masked bool) {
+	hdr := []byte{b0, 0}
+	switch n := len(payload); {
+	case n <= 125:
+		hdr[1] = byte(n)
+	case n <= 0xffff:
+		hdr[1] = 126
+		hdr = append(hdr, byte(n>>8), byte(n))
+	default:
+		hdr[1] = 127
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], uint64(n))
+		hdr = append(hdr, b[:]...)
+	}
+	data := append([]byte(nil), payload...)
+	if masked {
+		hdr[1] |= 0x80
+		mask := []byte{1, 2, 3, 4}
+		hdr = append(hdr, mask...)
+		for i := range data {
+			data[i] ^= mask[i%4]
+		}
+	}
+	if _, err := c.conn.Write(append(hdr, data...)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *wsClient) readFrame() (b0 byte, payload []byte) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+		c.t.Fatal(err)
+	}
+	n := int(hdr[1] & 0x7f)
+	switch n {
+	case 126:
+		var b [2]byte
+		io.ReadFull(c.br, b[:])
+		n = int(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		io.ReadFull(c.br, b[:])
+		n = int(binary.BigEndian.Uint64(b[:]))
+	}
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		c.t.Fatal(err)
+	}
+	return hdr[0], payload
+}
+
+func (c *wsClient) readClose() int {
+	b0, payload := c.readFrame()
+	expect(c.t, b0, byte(0x80|opClose))
+	if len(payload) < 2 {
+		return CloseNoStatusReceived
+	}
+	return int(binary.BigEndian.Uint16(payload))
+}
+
+func closePayload(code int, reason string) []byte {
+	b := []byte{byte(code >> 8), byte(code)}
+	return append(b, reason...)
+}
+
+func newWebSocketServer(opts *WebSocketOptions, fn func(ws *WebSocket, r *http.Request)) *httptest.Server {
+	vm := New()
+	vm.Get("/ws", WebSocketHandler(opts, fn))
+	return httptest.NewServer(vm)
+}
+
+func echo(errc chan<- error) func(ws *WebSocket, r *http.Request) {
+	return func(ws *WebSocket, r *http.Request) {
+		for {
+			typ, data, err := ws.ReadMessage()
+			if err != nil {
+				errc <- err
+				return
+			}
+			ws.WriteMessage(typ, data)
+		}
+	}
+}
+
+func TestWebSocketHandshake(t *testing.T) {
+	ts := newWebSocketServer(&WebSocketOptions{Subprotocols: []string{"chat", "superchat"}}, func(ws *WebSocket, r *http.Request) {})
+	defer ts.Close()
+
+	c := dialWebSocket(t, ts.URL+"/ws", http.Header{"Sec-Websocket-Protocol": {"superchat, chat"}})
+	defer c.conn.Close()
+	expect(t, c.resp.StatusCode, http.StatusSwitchingProtocols)
+	expect(t, c.resp.Header.Get("Sec-WebSocket-Accept"), "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=")
+	expect(t, c.resp.Header.Get("Sec-WebSocket-Protocol"), "chat")
+	expect(t, c.resp.Header.Get("Sec-WebSocket-Extensions"), "")
+	// the handler returned, so the connection is closed normally
+	expect(t, c.readClose(), CloseNormalClosure)
+}
+
+func TestWebSocketHandshakeErrors(t *testing.T) {
+	ts := newWebSocketServer(nil, func(ws *WebSocket, r *http.Request) {
+		t.Error("handler called")
+	})
+	defer ts.Close()
+
+	c := dialWebSocket(t, ts.URL+"/ws", http.Header{"Sec-Websocket-Version": {"8"}})
+	expect(t, c.resp.StatusCode, http.StatusUpgradeRequired)
+	expect(t, c.resp.Header.Get("Sec-WebSocket-Version"), "13")
+	c.conn.Close()
+
+	c = dialWebSocket(t, ts.URL+"/ws", http.Header{"Origin": {"http://evil.example"}})
+	expect(t, c.resp.StatusCode, http.StatusForbidden)
+	c.conn.Close()
+
+	c = dialWebSocket(t, ts.URL+"/ws", http.Header{"Sec-Websocket-Key": {"short"}})
+	expect(t, c.resp.StatusCode, http.StatusBadRequest)
+	c.conn.Close()
+
+	resp, err := http.Get(ts.URL + "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	expect(t, resp.StatusCode, http.StatusBadRequest)
+}
+
+func TestWebSocketSameOrigin(t *testing.T) {
+	ts := newWebSocketServer(nil, func(ws *WebSocket, r *http.Request) {})
+	defer ts.Close()
+	c := dialWebSocket(t, ts.URL+"/ws", http.Header{"Origin": {ts.URL}})
+	defer c.conn.Close()
+	expect(t, c.resp.StatusCode, http.StatusSwitchingProtocols)
+}
+
+func TestWebSocketEcho(t *testing.T) {
+	errc := make(chan error, 1)
+	var pongs []string
+	ts := newWebSocketServer(nil, func(ws *WebSocket, r *http.Request) {
+		ws.OnPong = func(data []byte) { pongs = append(pongs, string(data)) }
+		echo(errc)(ws, r)
+	})
+	defer ts.Close()
+	c := dialWebSocket(t, ts.URL+"/ws", nil)
+	defer c.conn.Close()
+
+	c.writeFrame(0x80|TextMessage, []byte("hello"), true)
+	b0, payload := c.readFrame()
+	expect(t, b0, byte(0x80|TextMessage))
+	expect(t, string(payload), "hello")
+
+	// a fragmented message with a ping in between
+	c.writeFrame(BinaryMessage, []byte("frag"), true)
+	c.writeFrame(0x80|opPing, []byte("are you there"), true)
+	c.writeFrame(opContinuation, []byte("men"), true)
+	c.writeFrame(0x80|opPong, []byte("unsolicited"), true)
+	c.writeFrame(0x80|opContinuation, []byte("ted"), true)
+	b0, payload = c.readFrame()
+	expect(t, b0, byte(0x80|opPong))
+	expect(t, string(payload), "are you there")
+	b0, payload = c.readFrame()
+	expect(t, b0, byte(0x80|BinaryMessage))
+	expect(t, string(payload), "fragmented")
+
+	c.writeFrame(0x80|opClose, closePayload(CloseGoingAway, "bye"), true)
+	expect(t, c.readClose(), CloseGoingAway)
+	err := <-errc
+	ce, ok := err.(*CloseError)
+	expect(t, ok, true)
+	expect(t, ce.Code, CloseGoingAway)
+	expect(t, ce.Reason, "bye")
+	expect(t, len(pongs), 1)
+}
+
+func TestWebSocketProtocolErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		write func(c *wsClient)
+		code  int
+	}{
+		{"unmasked", func(c *wsClient) { c.writeFrame(0x80|TextMessage, []byte("x"), false) }, CloseProtocolError},
+		{"reserved bits", func(c *wsClient) { c.writeFrame(0xc0|TextMessage, []byte("x"), true) }, CloseProtocolError},
+		{"unknown opcode", func(c *wsClient) { c.writeFrame(0x83, []byte("x"), true) }, CloseProtocolError},
+		{"continuation", func(c *wsClient) { c.writeFrame(0x80, []byte("x"), true) }, CloseProtocolError},
+		{"fragmented ping", func(c *wsClient) { c.writeFrame(opPing, nil, true) }, CloseProtocolError},
+		{"interleaved", func(c *wsClient) {
+			c.writeFrame(TextMessage, []byte("a"), true)
+			c.writeFrame(0x80|TextMessage, []byte("b"), true)
+		}, CloseProtocolError},
+		{"invalid utf-8", func(c *wsClient) { c.writeFrame(0x80|TextMessage, []byte{0xff, 0xfe}, true) }, CloseInvalidFramePayloadData},
+		{"invalid close code", func(c *wsClient) { c.writeFrame(0x80|opClose, closePayload(1005, ""), true) }, CloseProtocolError},
+		{"too big", func(c *wsClient) { c.writeFrame(0x80|BinaryMessage, make([]byte, 200), true) }, CloseMessageTooBig},
+		{"too big fragmented", func(c *wsClient) {
+			c.writeFrame(BinaryMessage, make([]byte, 60), true)
+			c.writeFrame(opContinuation, make([]byte, 60), true)
+		}, CloseMessageTooBig},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			errc := make(chan error, 1)
+			ts := newWebSocketServer(&WebSocketOptions{ReadLimit: 100}, echo(errc))
+			defer ts.Close()
+			c := dialWebSocket(t, ts.URL+"/ws", nil)
+			defer c.conn.Close()
+
+			tt.write(c)
+			expect(t, c.readClose(), tt.code)
+			err := <-errc
+			ce, ok := err.(*CloseError)
+			expect(t, ok, true)
+			expect(t, ce.Code, tt.code)
+		})
+	}
+}
+
+func TestWebSocketCompression(t *testing.T) {
+	errc := make(chan error, 1)
+	ts := newWebSocketServer(&WebSocketOptions{Compression: true, FragmentSize: 4}, echo(errc))
+	defer ts.Close()
+	c := dialWebSocket(t, ts.URL+"/ws", http.Header{"Sec-Websocket-Extensions": {"permessage-deflate; client_max_window_bits"}})
+	defer c.conn.Close()
+	expect(t, c.resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate; server_no_context_takeover; client_no_context_takeover")
+
+	msg := strings.Repeat("compress me ", 20)
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, flate.BestCompression)
+	fw.Write([]byte(msg))
+	fw.Flush()
+	c.writeFrame(0xc0|TextMessage, bytes.TrimSuffix(buf.Bytes(), []byte("\x00\x00\xff\xff")), true)
+
+	// the echo is compressed and split into fragments of 4 bytes
+	b0, data := c.readFrame()
+	expect(t, b0, byte(0x40|TextMessage))
+	for b0&0x80 == 0 {
+		var frame []byte
+		b0, frame = c.readFrame()
+		expect(t, b0&0x7f, byte(opContinuation))
+		data = append(data, frame...)
+	}
+	fr := flate.NewReader(io.MultiReader(bytes.NewReader(data), strings.NewReader("\x00\x00\xff\xff\x01\x00\x00\xff\xff")))
+	got, err := ioutil.ReadAll(fr)
+	expect(t, err, nil)
+	expect(t, string(got), msg)
+}
+
+func TestWebSocketCompressionReadLimit(t *testing.T) {
+	errc := make(chan error, 1)
+	ts := newWebSocketServer(&WebSocketOptions{Compression: true, ReadLimit: 100}, echo(errc))
+	defer ts.Close()
+	c := dialWebSocket(t, ts.URL+"/ws", http.Header{"Sec-Websocket-Extensions": {"permessage-deflate"}})
+	defer c.conn.Close()
+
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, flate.BestCompression)
+	fw.Write(make([]byte, 1000))
+	fw.Flush()
+	c.writeFrame(0xc0|BinaryMessage, bytes.TrimSuffix(buf.Bytes(), []byte("\x00\x00\xff\xff")), true)
+	expect(t, c.readClose(), CloseMessageTooBig)
+}
+
+func TestWebSocketCompressionDeclined(t *testing.T) {
+	ts := newWebSocketServer(&WebSocketOptions{Compression: true}, func(ws *WebSocket, r *http.Request) {
+		expect(t, ws.Compressed(), false)
+	})
+	defer ts.Close()
+	c := dialWebSocket(t, ts.URL+"/ws", http.Header{"Sec-Websocket-Extensions": {"permessage-deflate; server_max_window_bits=10"}})
+	defer c.conn.Close()
+	expect(t, c.resp.Header.Get("Sec-WebSocket-Extensions"), "")
+}
+
+func TestWebSocketWriteClose(t *testing.T) {
+	errc := make(chan error, 1)
+	ts := newWebSocketServer(nil, func(ws *WebSocket, r *http.Request) {
+		ws.WriteClose(ClosePolicyViolation, "go away")
+		expect(t, ws.WriteMessage(TextMessage, []byte("late")), ErrCloseSent)
+		_, _, err := ws.ReadMessage()
+		errc <- err
+	})
+	defer ts.Close()
+	c := dialWebSocket(t, ts.URL+"/ws", nil)
+	defer c.conn.Close()
+
+	expect(t, c.readClose(), ClosePolicyViolation)
+	c.writeFrame(0x80|opClose, closePayload(ClosePolicyViolation, ""), true)
+	ce, ok := (<-errc).(*CloseError)
+	expect(t, ok, true)
+	expect(t, ce.Code, ClosePolicyViolation)
+}
+
+func TestWebSocketGracefulShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	url, served := serveTestApp(t, ctx, WebSocketHandler(nil, echo(errc)), func(o *Options) {
+		o.GracefulTimeout = 5 * time.Second
+	})
+	c := dialWebSocket(t, url, nil)
+	defer c.conn.Close()
+	c.writeFrame(0x80|TextMessage, []byte("ping"), true)
+	c.readFrame()
+
+	cancel()
+	expect(t, c.readClose(), CloseGoingAway)
+	// the server waits for the close handshake before Serve returns
+	select {
+	case <-served:
+		t.Fatal("Serve returned before the WebSocket was closed")
+	case <-time.After(100 * time.Millisecond):
+	}
+	c.writeFrame(0x80|opClose, closePayload(CloseGoingAway, ""), true)
+	ce, ok := (<-errc).(*CloseError)
+	expect(t, ok, true)
+	expect(t, ce.Code, CloseGoingAway)
+	select {
+	case err := <-served:
+		expect(t, err, nil)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop")
+	}
+}
+
+func TestWebSocketGracefulShutdownUnansweredClose(t *testing.T) {
+	timeout := WebSocketCloseTimeout
+	WebSocketCloseTimeout = 200 * time.Millisecond
+	defer func() { WebSocketCloseTimeout = timeout }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	release := make(chan struct{})
+	defer close(release)
+	url, served := serveTestApp(t, ctx, WebSocketHandler(nil, func(ws *WebSocket, r *http.Request) {
+		// a handler which never reads does not see the close frame
+		<-release
+	}), func(o *Options) {
+		o.GracefulTimeout = 5 * time.Second
+	})
+	c := dialWebSocket(t, url, nil)
+	defer c.conn.Close()
+	c2 := dialWebSocket(t, url, nil)
+	defer c2.conn.Close()
+
+	start := time.Now()
+	cancel()
+	expect(t, c.readClose(), CloseGoingAway)
+	expect(t, c2.readClose(), CloseGoingAway)
+	select {
+	case err := <-served:
+		expect(t, err, nil)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop")
+	}
+	expect(t, time.Since(start) >= WebSocketCloseTimeout, true)
+	// the connections have been closed
+	_, err := c.br.ReadByte()
+	refute(t, err, nil)
+}
+
+func TestWebSocketShutdownOfEmbeddedServer(t *testing.T) {
+	vm := New()
+	errc := make(chan error, 1)
+	vm.Get("/", WebSocketHandler(nil, echo(errc)))
+	srv := vm.NewServer()
+	srv.NoSignalHandling = true
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	c := dialWebSocket(t, "http://"+l.Addr().String()+"/", nil)
+	defer c.conn.Close()
+
+	// the shutdown hooks also run without Server.Stop
+	srv.Server.Shutdown(context.Background())
+	expect(t, c.readClose(), CloseGoingAway)
+	c.writeFrame(0x80|opClose, closePayload(CloseGoingAway, ""), true)
+	ce, ok := (<-errc).(*CloseError)
+	expect(t, ok, true)
+	expect(t, ce.Code, CloseGoingAway)
+}